@@ -1,18 +1,18 @@
 package apis
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 )
 
-// CreateAPI sends the API creation request and returns the API ID.
-func CreateAPI(name, orgID, authToken string) (string, error) {
-	jsonPayload := fmt.Sprintf(`{
+// apiPayload returns the definition of the API created and updated for every tenant.
+func apiPayload(name, description string) string {
+	return fmt.Sprintf(`{
 		"name": "%s",
-		"description": "This API is used to connect to the TestAPI service",
+		"description": %q,
 		"context": "/%s",
 		"version": "1.0.0",
 		"lifeCycleStatus": "CREATED",
@@ -50,26 +50,35 @@ func CreateAPI(name, orgID, authToken string) (string, error) {
 			"apiOwner": "ca0c41b4-5bbd-48c8-b319-cf64d98e85b1",
 			"vendor": "WSO2"
 		}
-	}`, name, name)
+	}`, name, description, name)
+}
 
-	url := fmt.Sprintf("%s?organizationId=%s&openAPIVersion=%s", apisBasePath, orgID, openAPIVersion)
+// CreateAPI sends the API creation request and returns the API ID. If an API with the same name
+// already exists in the organization its ID is returned instead.
+func (c *Client) CreateAPI(ctx context.Context, name, orgID string) (string, error) {
+	jsonPayload := apiPayload(name, "This API is used to connect to the TestAPI service")
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(jsonPayload)))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Content-Type", "application/json")
+	url := fmt.Sprintf("%s?organizationId=%s&openAPIVersion=%s", c.apisBasePath, orgID, openAPIVersion)
 
-	resp, err := insecureClient.Do(req)
+	resp, err := c.do(ctx, request{method: "POST", url: url, body: []byte(jsonPayload), cred: c.publisher})
 	if err != nil {
 		return "", fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+		apiErr := newError(resp)
+		if !IsConflict(apiErr) {
+			return "", apiErr
+		}
+		apiID, err := c.FindAPI(ctx, name, orgID)
+		if err != nil {
+			return "", fmt.Errorf("API %s already exists but lookup failed: %w", name, err)
+		}
+		if apiID == "" {
+			return "", apiErr
+		}
+		return apiID, nil
 	}
 
 	var apiResp APIResponse
@@ -79,3 +88,90 @@ func CreateAPI(name, orgID, authToken string) (string, error) {
 
 	return apiResp.ID, nil
 }
+
+// UpdateAPI replaces the description of an API, which makes APIM publish an API update event.
+func (c *Client) UpdateAPI(ctx context.Context, apiID, name, orgID, description string) error {
+	jsonPayload := apiPayload(name, description)
+	url := fmt.Sprintf("%s/%s?organizationId=%s", c.apisBasePath, apiID, orgID)
+
+	// Applying the same definition twice leaves the API unchanged, so the call is safe to retry.
+	resp, err := c.do(ctx, request{method: "PUT", url: url, body: []byte(jsonPayload), cred: c.publisher, idempotent: true})
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(resp)
+	}
+	return nil
+}
+
+// ChangeLifecycle applies a lifecycle action such as Publish or Deprecate to an API and returns the
+// resulting lifecycle state.
+func (c *Client) ChangeLifecycle(ctx context.Context, apiID, orgID, action string) (string, error) {
+	action = url.QueryEscape(action)
+	url := fmt.Sprintf("%s/change-lifecycle?apiId=%s&action=%s&organizationId=%s", c.apisBasePath, apiID, action, orgID)
+
+	resp, err := c.do(ctx, request{method: "POST", url: url, cred: c.publisher})
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(resp)
+	}
+
+	var lifecycle LifecycleResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lifecycle); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	return lifecycle.LifecycleState.State, nil
+}
+
+// FindAPI looks up an API of the organization by name and returns its ID, or an empty string if
+// there is none.
+func (c *Client) FindAPI(ctx context.Context, name, orgID string) (string, error) {
+	query := url.QueryEscape(fmt.Sprintf(`name:"%s"`, name))
+	url := fmt.Sprintf("%s?query=%s&organizationId=%s", c.apisBasePath, query, orgID)
+
+	resp, err := c.do(ctx, request{method: "GET", url: url, cred: c.publisher, idempotent: true})
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(resp)
+	}
+
+	var apiList APIList
+	if err := json.NewDecoder(resp.Body).Decode(&apiList); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	// The search matches name prefixes, so compare the exact name.
+	for _, api := range apiList.List {
+		if api.Name == name {
+			return api.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// DeleteAPI sends a DELETE request to remove an API with all its revisions. An API that no longer
+// exists is not an error.
+func (c *Client) DeleteAPI(ctx context.Context, apiID, orgID string) error {
+	url := fmt.Sprintf("%s/%s?organizationId=%s", c.apisBasePath, apiID, orgID)
+
+	resp, err := c.do(ctx, request{method: "DELETE", url: url, cred: c.publisher, idempotent: true})
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return newError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package apis
+
+import (
+	"apim-multi-tenant-asb-load-test/auth"
+	"apim-multi-tenant-asb-load-test/config"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client sends requests to an APIM cluster. It authenticates publisher calls with the publisher
+// credential and admin and internal calls with the admin credential, and retries transient failures.
+// Progress is written to its logger.
+type Client struct {
+	apisBasePath       string
+	envsBasePath       string
+	dataplanesBasePath string
+
+	http      *http.Client
+	publisher auth.Credential
+	admin     auth.Credential
+	retry     config.RetryConfig
+	log       *log.Logger
+}
+
+// request describes a single APIM call.
+type request struct {
+	method string
+	url    string
+	body   []byte
+	cred   auth.Credential
+	// idempotent marks calls that can safely be sent again even if APIM may already have processed
+	// them. Other calls are only retried when APIM says it did not process them (429 and 503).
+	idempotent bool
+}
+
+// NewHTTPClient returns the HTTP client shared by every APIM call, including token requests.
+func NewHTTPClient(cfg config.APIMConfig) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: cfg.Timeout, Transport: transport}, nil
+}
+
+// newTLSConfig builds the TLS settings of the shared transport.
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.Insecure,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewClient returns a client for the APIM cluster described by cfg that logs to logger.
+func NewClient(cfg config.APIMConfig, httpClient *http.Client, publisher, admin auth.Credential, logger *log.Logger) *Client {
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	return &Client{
+		apisBasePath:       baseURL + apisPath,
+		envsBasePath:       baseURL + envsPath,
+		dataplanesBasePath: baseURL + dataplanesPath,
+		http:               httpClient,
+		publisher:          publisher,
+		admin:              admin,
+		retry:              cfg.Retry,
+		log:                logger,
+	}
+}
+
+// do sends r, retrying transient failures according to the retry policy. A 401 response invalidates
+// the cached token and the request is sent once more with a fresh one, without counting as a retry.
+func (c *Client) do(ctx context.Context, r request) (*http.Response, error) {
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		header, err := r.cred.Authorization(ctx)
+		var resp *http.Response
+		if err != nil {
+			err = fmt.Errorf("failed to get credentials: %w", err)
+		} else {
+			resp, err = c.send(ctx, r, header)
+		}
+
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && !refreshed {
+			resp.Body.Close()
+			r.cred.Invalidate(header)
+			refreshed = true
+			attempt--
+			continue
+		}
+
+		if attempt >= c.retry.MaxAttempts || ctx.Err() != nil || !c.retryable(r, resp, err) {
+			return resp, err
+		}
+
+		delay := c.backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// send builds and sends a single attempt of r with the Authorization header.
+func (c *Client) send(ctx context.Context, r request, header string) (*http.Response, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if r.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", header)
+
+	return c.http.Do(req)
+}
+
+// retryable reports whether an attempt of r that ended with resp or err may be sent again.
+func (c *Client) retryable(r request, resp *http.Response, err error) bool {
+	if err != nil {
+		// The request may have reached APIM before the connection failed.
+		return r.idempotent
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return r.idempotent
+	}
+	return false
+}
+
+// backoff returns how long to wait before the next attempt: the Retry-After of resp if it has one,
+// otherwise an exponentially growing delay with full jitter.
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if delay, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return delay
+		}
+	}
+
+	limit := c.retry.BaseDelay << (attempt - 1)
+	if limit <= 0 || limit > c.retry.MaxDelay {
+		limit = c.retry.MaxDelay
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -1,14 +1,10 @@
 package apis
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"os"
-	"strings"
-	"sync"
 )
 
 // Topic represents the structure of topics in the response.
@@ -23,22 +19,15 @@ type RegisterResponse struct {
 	Topics  []Topic `json:"topics"`
 }
 
-// RegisterDataplaneTopics sends a POST request to register dataplane topics.
-func RegisterDataplaneTopics(orgID, dataPlaneID, authToken string) ([]Topic, error) {
+// RegisterDataplaneTopics sends a POST request to register dataplane topics. If the dataplane already
+// has topics registered they are fetched and returned instead.
+func (c *Client) RegisterDataplaneTopics(ctx context.Context, orgID, dataPlaneID string) ([]Topic, error) {
 	url := fmt.Sprintf(
-		"%s/%s/register-dataplane-topics?organizationId=%s", dataplanesBasePath, dataPlaneID, orgID,
+		"%s/%s/register-dataplane-topics?organizationId=%s", c.dataplanesBasePath, dataPlaneID, orgID,
 	)
 
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	// Set headers
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", authToken)) // Use your base64-encoded credentials
-
 	// Execute the request
-	resp, err := insecureClient.Do(req)
+	resp, err := c.do(ctx, request{method: "POST", url: url, cred: c.admin})
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %v", err)
 	}
@@ -46,8 +35,16 @@ func RegisterDataplaneTopics(orgID, dataPlaneID, authToken string) ([]Topic, err
 
 	// Check response status
 	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		apiErr := newError(resp)
+		if !IsConflict(apiErr) {
+			return nil, apiErr
+		}
+		topics, err := c.GetDataplaneTopics(ctx, orgID, dataPlaneID)
+		if err != nil {
+			return nil, fmt.Errorf("dataplane topics already registered but lookup failed: %w", err)
+		}
+		c.log.Printf("Dataplane topics already registered for DataPlaneID: %s, OrgID: %s\n", dataPlaneID, orgID)
+		return topics, nil
 	}
 
 	// Parse JSON response
@@ -56,95 +53,29 @@ func RegisterDataplaneTopics(orgID, dataPlaneID, authToken string) ([]Topic, err
 		return nil, fmt.Errorf("failed to parse response: %v", err)
 	}
 
-	fmt.Printf("Successfully registered dataplane topics for DataPlaneID: %s, OrgID: %s\n", dataPlaneID, orgID)
+	c.log.Printf("Successfully registered dataplane topics for DataPlaneID: %s, OrgID: %s\n", dataPlaneID, orgID)
 	return response.Topics, nil
 }
 
-// appendTopicsToFile writes topics to the file atomically using a mutex.
-func appendTopicsToFile(topics []Topic, filename string, mutex *sync.Mutex) error {
-	// Lock the mutex to ensure atomic writes
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
-	}
-	defer file.Close()
-
-	for _, topic := range topics {
-		_, err := file.WriteString(fmt.Sprintf("%s\n%s\n", topic.TopicName, topic.ConnectionString))
-		if err != nil {
-			return fmt.Errorf("failed to write to file: %v", err)
-		}
-	}
-	return nil
-}
-
-// processRegistration handles registering topics and writing them to the file.
-func processRegistration(orgID, dataPlaneID, authToken, outputFileName string, mutex *sync.Mutex, wg *sync.WaitGroup) {
-	defer wg.Done()
+// GetDataplaneTopics sends a GET request for the topics already registered for a dataplane.
+func (c *Client) GetDataplaneTopics(ctx context.Context, orgID, dataPlaneID string) ([]Topic, error) {
+	url := fmt.Sprintf(
+		"%s/%s/dataplane-topics?organizationId=%s", c.dataplanesBasePath, dataPlaneID, orgID,
+	)
 
-	topics, err := RegisterDataplaneTopics(orgID, dataPlaneID, authToken)
+	resp, err := c.do(ctx, request{method: "GET", url: url, cred: c.admin, idempotent: true})
 	if err != nil {
-		log.Printf("Error registering topics for OrgID: %s, DataPlaneID: %s - %v", orgID, dataPlaneID, err)
-		return
+		return nil, fmt.Errorf("request failed: %v", err)
 	}
+	defer resp.Body.Close()
 
-	if err := appendTopicsToFile(topics, outputFileName, mutex); err != nil {
-		log.Printf("Error writing topics for OrgID: %s, DataPlaneID: %s - %v", orgID, dataPlaneID, err)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp)
 	}
-}
 
-// CreateDataplaneTopicsFromFile reads the input file and processes registrations in parallel.
-func CreateDataplaneTopicsFromFile(filename, authToken, outputFileName string, maxParallel int) error {
-	file, err := os.ReadFile(filename)
-	if err != nil {
-		return fmt.Errorf("failed to read input file: %v", err)
-	}
-
-	lines := strings.Split(strings.TrimSpace(string(file)), "\n")
-
-	var wg sync.WaitGroup                   // WaitGroup to wait for all goroutines
-	mutex := &sync.Mutex{}                  // Mutex to ensure atomic file writes
-	sem := make(chan struct{}, maxParallel) // Semaphore to control parallelism
-
-	for _, line := range lines {
-		parts := strings.Split(line, ",")
-		if len(parts) != 2 {
-			log.Printf("Invalid line: %s", line)
-			continue
-		}
-		orgID, dataPlaneID := parts[0], parts[1]
-
-		// Acquire semaphore slot
-		sem <- struct{}{}
-		wg.Add(1)
-
-		go func(orgID, dataPlaneID string) {
-			defer func() { <-sem }() // Release semaphore slot
-			processRegistration(orgID, dataPlaneID, authToken, outputFileName, mutex, &wg)
-		}(orgID, dataPlaneID)
+	var response RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
 	}
-
-	wg.Wait() // Wait for all goroutines to finish
-	return nil
+	return response.Topics, nil
 }
-
-//// appendTopicsToFile writes topic names and connection strings to the specified file.
-//func appendTopicsToFile(topics []Topic, filename string) error {
-//	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-//	if err != nil {
-//		return fmt.Errorf("failed to open file: %v", err)
-//	}
-//	defer file.Close()
-//
-//	for _, topic := range topics {
-//		_, err := file.WriteString(fmt.Sprintf("%s\n%s\n", topic.TopicName, topic.ConnectionString))
-//		if err != nil {
-//			return fmt.Errorf("failed to write to file: %v", err)
-//		}
-//	}
-//
-//	return nil
-//}
@@ -1,10 +1,9 @@
 package apis
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 )
 
@@ -32,8 +31,9 @@ type VHost struct {
 	WssPort     int    `json:"wssPort"`
 }
 
-// CreateEnvironment sends a POST request to create an environment
-func CreateEnvironment(orgID, name, dataPlaneID, authToken string) error {
+// CreateEnvironment sends a POST request to create an environment and returns its ID, or the ID of
+// the existing environment with the same name
+func (c *Client) CreateEnvironment(ctx context.Context, orgID, name, dataPlaneID string) (string, error) {
 	// Define the request payload
 	payload := EnvironmentRequest{
 		Name:                     name,
@@ -60,38 +60,82 @@ func CreateEnvironment(orgID, name, dataPlaneID, authToken string) error {
 	// Marshal payload to JSON
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %v", err)
+		return "", fmt.Errorf("failed to marshal payload: %v", err)
 	}
 
-	// Create the HTTP request
-	url := fmt.Sprintf("%s?organizationId=%s", envsBasePath, orgID)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
+	// Send the request
+	url := fmt.Sprintf("%s?organizationId=%s", c.envsBasePath, orgID)
+	resp, err := c.do(ctx, request{method: "POST", url: url, body: payloadBytes, cred: c.admin})
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return "", fmt.Errorf("request failed: %v", err)
 	}
+	defer resp.Body.Close()
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", authToken))
+	// Check for non-2xx status code. An existing environment with the same name is returned as is,
+	// so provisioning a partially set-up tenant converges.
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := newError(resp)
+		if !IsConflict(apiErr) {
+			return "", apiErr
+		}
+		envID, err := c.FindEnvironment(ctx, orgID, name)
+		if err != nil {
+			return "", fmt.Errorf("environment %s already exists but lookup failed: %w", name, err)
+		}
+		if envID == "" {
+			return "", apiErr
+		}
+		c.log.Println("Environment already exists.")
+		return envID, nil
+	}
 
-	// Send the request
-	resp, err := insecureClient.Do(req)
+	var envResp EnvironmentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envResp); err != nil {
+		return "", fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	c.log.Println("Environment successfully created!")
+	return envResp.ID, nil
+}
+
+// FindEnvironment looks up an environment of the organization by name and returns its ID, or an
+// empty string if there is none.
+func (c *Client) FindEnvironment(ctx context.Context, orgID, name string) (string, error) {
+	url := fmt.Sprintf("%s?organizationId=%s", c.envsBasePath, orgID)
+	resp, err := c.do(ctx, request{method: "GET", url: url, cred: c.admin, idempotent: true})
 	if err != nil {
-		return fmt.Errorf("request failed: %v", err)
+		return "", fmt.Errorf("request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(resp)
 	}
 
-	// Check for non-2xx status code
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("non-2xx status code: %d, response: %s", resp.StatusCode, string(body))
+	var envs EnvironmentList
+	if err := json.NewDecoder(resp.Body).Decode(&envs); err != nil {
+		return "", fmt.Errorf("failed to parse response: %v", err)
+	}
+	for _, env := range envs.List {
+		if env.Name == name {
+			return env.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// DeleteEnvironment sends a DELETE request to remove an environment. An environment that no longer
+// exists is not an error.
+func (c *Client) DeleteEnvironment(ctx context.Context, orgID, envID string) error {
+	url := fmt.Sprintf("%s/%s?organizationId=%s", c.envsBasePath, envID, orgID)
+	resp, err := c.do(ctx, request{method: "DELETE", url: url, cred: c.admin, idempotent: true})
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
 	}
+	defer resp.Body.Close()
 
-	fmt.Println("Environment successfully created!")
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return newError(resp)
+	}
 	return nil
 }
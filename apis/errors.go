@@ -0,0 +1,89 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error is an error response from APIM.
+type Error struct {
+	StatusCode int
+	// Code is the APIM error code, which is more specific than the HTTP status.
+	Code        string
+	Message     string
+	Description string
+	// Body is the raw response body, kept for responses that aren't APIM error documents.
+	Body string
+}
+
+// errorResponse represents the structure of an APIM error response.
+type errorResponse struct {
+	Code        json.RawMessage `json:"code"`
+	Message     string          `json:"message"`
+	Description string          `json:"description"`
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Message == "" && e.Description == "":
+		return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Body)
+	case e.Description == "":
+		return fmt.Sprintf("status %d, code %s: %s", e.StatusCode, e.Code, e.Message)
+	default:
+		return fmt.Sprintf("status %d, code %s: %s: %s", e.StatusCode, e.Code, e.Message, e.Description)
+	}
+}
+
+// newError reads the body of an unexpected response and parses it into an Error.
+func newError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(resp.Body)
+	apiErr := &Error{StatusCode: resp.StatusCode, Body: string(body)}
+
+	var parsed errorResponse
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		apiErr.Code = strings.Trim(string(parsed.Code), `"`)
+		apiErr.Message = parsed.Message
+		apiErr.Description = parsed.Description
+	}
+	return apiErr
+}
+
+// StatusCode returns the HTTP status of an APIM error, or 0 if err didn't come from an APIM response.
+func StatusCode(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// IsConflict reports whether err means the resource being created already exists.
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+// IsNotFound reports whether err means the resource doesn't exist.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// codeRevisionLimit is APIM's error code for an API that has as many revisions as it allows.
+const codeRevisionLimit = "902007"
+
+// IsRevisionLimit reports whether err means the API already has as many revisions as APIM allows.
+// Responses without the error code are recognized by their message.
+func IsRevisionLimit(err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	if apiErr.Code == codeRevisionLimit {
+		return true
+	}
+	text := strings.ToLower(apiErr.Message + " " + apiErr.Description)
+	return strings.Contains(text, "maximum revisions") || strings.Contains(text, "maximum number of revisions")
+}
@@ -0,0 +1,57 @@
+package apis
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIsRevisionLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   bool
+	}{
+		{
+			name:   "revision limit",
+			status: http.StatusBadRequest,
+			body:   `{"code":902007,"message":"Maximum revisions reached","description":"Maximum revisions reached for API or API Product with UUID: 6a1c3b8e-2f0d-4c52-9d1e-7b4f0e2a9c31","moreInfo":"","error":[]}`,
+			want:   true,
+		},
+		{
+			name:   "reworded revision limit",
+			status: http.StatusBadRequest,
+			body:   `{"code":902007,"message":"Revision quota exhausted","description":"","moreInfo":"","error":[]}`,
+			want:   true,
+		},
+		{
+			name:   "revision limit without a code",
+			status: http.StatusBadRequest,
+			body:   `{"message":"Bad Request","description":"Maximum number of revisions per API reached"}`,
+			want:   true,
+		},
+		{
+			name:   "other bad request",
+			status: http.StatusBadRequest,
+			body:   `{"code":900700,"message":"Bad Request","description":"Invalid organization","moreInfo":"","error":[]}`,
+		},
+		{
+			name:   "revision limit code with another status",
+			status: http.StatusInternalServerError,
+			body:   `{"code":902007,"message":"Maximum revisions reached"}`,
+		},
+		{name: "not an APIM error document", status: http.StatusBadRequest, body: `<html>Bad Request</html>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newError(&http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))})
+			wrapped := fmt.Errorf("revision request failed: %w", err)
+			if got := IsRevisionLimit(wrapped); got != tt.want {
+				t.Errorf("IsRevisionLimit(%v) = %t, want %t", err, got, tt.want)
+			}
+		})
+	}
+}
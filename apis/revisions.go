@@ -1,37 +1,30 @@
 package apis
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"sort"
 )
 
 // CreateRevision sends the revision creation request and returns the revision ID.
-func CreateRevision(apiID, orgID, authToken string) (string, error) {
-	jsonPayload := `{
-		"description": "first revision"
-	}`
-
-	url := fmt.Sprintf(revisionPath, apisBasePath, apiID) + fmt.Sprintf("?organizationId=%s", orgID)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(jsonPayload)))
+func (c *Client) CreateRevision(ctx context.Context, apiID, orgID, description string) (string, error) {
+	jsonPayload, err := json.Marshal(map[string]string{"description": description})
 	if err != nil {
-		return "", fmt.Errorf("failed to create revision request: %w", err)
+		return "", fmt.Errorf("failed to marshal request body: %v", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := insecureClient.Do(req)
+	url := fmt.Sprintf(revisionPath, c.apisBasePath, apiID) + fmt.Sprintf("?organizationId=%s", orgID)
+
+	resp, err := c.do(ctx, request{method: "POST", url: url, body: jsonPayload, cred: c.publisher})
 	if err != nil {
 		return "", fmt.Errorf("revision request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+		return "", newError(resp)
 	}
 
 	var revResp RevisionResponse
@@ -42,16 +35,34 @@ func CreateRevision(apiID, orgID, authToken string) (string, error) {
 	return revResp.ID, nil
 }
 
-// DeployAPIRevision sends a POST request to deploy an API revision.
-func DeployAPIRevision(apiID, revisionID, organizationID, dataPlaneID, authToken string) error {
+// GetRevisions returns the revisions of an API, oldest first, with the environments each is deployed to.
+func (c *Client) GetRevisions(ctx context.Context, apiID, organizationID string) (*RevisionList, error) {
+	url := fmt.Sprintf(revisionPath, c.apisBasePath, apiID) + fmt.Sprintf("?organizationId=%s", organizationID)
+
+	resp, err := c.do(ctx, request{method: "GET", url: url, cred: c.publisher, idempotent: true})
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp)
+	}
+
+	var revisions RevisionList
+	if err := json.NewDecoder(resp.Body).Decode(&revisions); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	sort.SliceStable(revisions.List, func(i, j int) bool { return revisions.List[i].CreatedTime < revisions.List[j].CreatedTime })
+	return &revisions, nil
+}
+
+// DeployAPIRevision sends a POST request to deploy an API revision to the named environment.
+func (c *Client) DeployAPIRevision(ctx context.Context, apiID, revisionID, organizationID, name, vhost string) error {
 	url := fmt.Sprintf(
-		"%s/%s/deploy-revision?revisionId=%s&organizationId=%s", apisBasePath, apiID, revisionID, organizationID,
+		"%s/%s/deploy-revision?revisionId=%s&organizationId=%s", c.apisBasePath, apiID, revisionID, organizationID,
 	)
 
-	// Derive name and vhost using dataPlaneID
-	name := fmt.Sprintf("development-%s", dataPlaneID[len(dataPlaneID)-6:])
-	vhost := fmt.Sprintf("%s-dev.choreo-dv.pdp.dev", name)
-
 	// Prepare request body
 	requestBody := []map[string]interface{}{
 		{
@@ -65,28 +76,90 @@ func DeployAPIRevision(apiID, revisionID, organizationID, dataPlaneID, authToken
 		return fmt.Errorf("failed to marshal request body: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyBytes))
+	// Send request. Deploying the same revision twice leaves the gateway in the same state, but every
+	// accepted deployment emits another gateway event, so the call is only retried when APIM didn't
+	// process it.
+	resp, err := c.do(ctx, request{method: "POST", url: url, body: bodyBytes, cred: c.publisher})
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return fmt.Errorf("request failed: %v", err)
 	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusCreated {
+		return newError(resp)
+	}
+	return nil
+}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", authToken))
+// GetDeployments returns the environments the revisions of an API are currently deployed to.
+func (c *Client) GetDeployments(ctx context.Context, apiID, organizationID string) ([]Deployment, error) {
+	url := fmt.Sprintf("%s/%s/deployments?organizationId=%s", c.apisBasePath, apiID, organizationID)
 
-	// Send request
-	resp, err := insecureClient.Do(req)
+	resp, err := c.do(ctx, request{method: "GET", url: url, cred: c.publisher, idempotent: true})
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp)
+	}
+
+	var deployments []Deployment
+	if err := json.NewDecoder(resp.Body).Decode(&deployments); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return deployments, nil
+}
+
+// UndeployAPIRevision sends a POST request to undeploy an API revision from the named environment.
+func (c *Client) UndeployAPIRevision(ctx context.Context, apiID, revisionID, organizationID, name, vhost string) error {
+	url := fmt.Sprintf(
+		"%s/%s/undeploy-revision?revisionId=%s&organizationId=%s", c.apisBasePath, apiID, revisionID, organizationID,
+	)
+
+	requestBody := []map[string]interface{}{
+		{
+			"name":               name,
+			"displayOnDevportal": true,
+			"vhost":              vhost,
+		},
+	}
+	bodyBytes, err := json.Marshal(requestBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %v", err)
+	}
+
+	// Like deployments, every accepted undeployment emits a gateway event.
+	resp, err := c.do(ctx, request{method: "POST", url: url, body: bodyBytes, cred: c.publisher})
 	if err != nil {
 		return fmt.Errorf("request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// Check response status
 	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		return newError(resp)
+	}
+	return nil
+}
+
+// DeleteRevision sends a DELETE request to remove an undeployed API revision. A revision that no
+// longer exists is not an error.
+func (c *Client) DeleteRevision(ctx context.Context, apiID, revisionID, organizationID string) error {
+	url := fmt.Sprintf(revisionPath, c.apisBasePath, apiID) + fmt.Sprintf("/%s?organizationId=%s", revisionID, organizationID)
+
+	resp, err := c.do(ctx, request{method: "DELETE", url: url, cred: c.publisher, idempotent: true})
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
 	}
+	defer resp.Body.Close()
 
-	fmt.Println("API revision deployed successfully.")
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return newError(resp)
+	}
 	return nil
 }
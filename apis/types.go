@@ -5,6 +5,23 @@ type APIResponse struct {
 	ID string `json:"id"`
 }
 
+// APIList represents the structure of the API search response.
+type APIList struct {
+	Count int `json:"count"`
+	List  []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"list"`
+}
+
+// LifecycleResponse represents the structure of the lifecycle change response.
+type LifecycleResponse struct {
+	WorkflowStatus string `json:"workflowStatus"`
+	LifecycleState struct {
+		State string `json:"state"`
+	} `json:"lifecycleState"`
+}
+
 // RevisionResponse represents the structure of the revision response.
 type RevisionResponse struct {
 	ID      string `json:"id"`
@@ -12,3 +29,33 @@ type RevisionResponse struct {
 		ID string `json:"id"`
 	} `json:"apiInfo"`
 }
+
+// RevisionList represents the structure of the revision listing response.
+type RevisionList struct {
+	Count int `json:"count"`
+	List  []struct {
+		ID             string       `json:"id"`
+		Description    string       `json:"description"`
+		CreatedTime    int64        `json:"createdTime"`
+		DeploymentInfo []Deployment `json:"deploymentInfo"`
+	} `json:"list"`
+}
+
+// EnvironmentResponse represents the structure of an environment returned by the admin API.
+type EnvironmentResponse struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// EnvironmentList represents the structure of the environment listing response.
+type EnvironmentList struct {
+	Count int                   `json:"count"`
+	List  []EnvironmentResponse `json:"list"`
+}
+
+// Deployment represents a revision deployed to an environment.
+type Deployment struct {
+	RevisionID string `json:"revisionUuid"`
+	Name       string `json:"name"`
+	VHost      string `json:"vhost"`
+}
@@ -1,20 +1,59 @@
 package asb_client
 
 import (
+	"apim-multi-tenant-asb-load-test/metrics"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
 	"log"
 	"math/rand"
+	"net/http"
 	"sync"
 	"time"
 )
 
-// Message struct to store topic and message body information.
+// Message struct to store topic and message body information with the Service Bus metadata of the
+// message. EnqueuedAt is when Service Bus accepted the message and ReceivedAt when the listener
+// received it.
 type Message struct {
-	Topic   string
-	Content string
+	Topic        string
+	Subscription string
+	Content      string
+	ContentType  string
+	MessageID    string
+	// SequenceNumber is unique per message within the topic. DeliveryCount is above one when the
+	// message was delivered before without being completed.
+	SequenceNumber        int64
+	DeliveryCount         uint32
+	ApplicationProperties map[string]any
+	EnqueuedAt            time.Time
+	ReceivedAt            time.Time
+}
+
+// newMessage copies a message received on a subscription of a topic with its metadata.
+func newMessage(topicName, subscriptionName string, msg *azservicebus.ReceivedMessage, receivedAt time.Time) Message {
+	message := Message{
+		Topic:                 topicName,
+		Subscription:          subscriptionName,
+		Content:               string(msg.Body),
+		MessageID:             msg.MessageID,
+		DeliveryCount:         msg.DeliveryCount,
+		ApplicationProperties: msg.ApplicationProperties,
+		ReceivedAt:            receivedAt,
+	}
+	if msg.ContentType != nil {
+		message.ContentType = *msg.ContentType
+	}
+	if msg.SequenceNumber != nil {
+		message.SequenceNumber = *msg.SequenceNumber
+	}
+	if msg.EnqueuedTime != nil {
+		message.EnqueuedAt = *msg.EnqueuedTime
+	}
+	return message
 }
 
 // Generates a random subscription name.
@@ -24,62 +63,95 @@ func generateRandomSubscriptionName() string {
 }
 
 // Creates a subscription for a given topic with a random name.
-func createSubscription(ctx context.Context, adminClient *admin.Client, topicName string) string {
+func createSubscription(ctx context.Context, adminClient *admin.Client, topicName string, logger *log.Logger) string {
 	subscriptionName := generateRandomSubscriptionName()
 
 	_, err := adminClient.CreateSubscription(ctx, topicName, subscriptionName, nil)
 	if err != nil {
-		log.Fatalf("Failed to create subscription: %v", err)
+		logger.Fatalf("Failed to create subscription: %v", err)
 	}
 
-	log.Printf("Created subscription: %s for topic: %s", subscriptionName, topicName)
+	logger.Printf("Created subscription: %s for topic: %s", subscriptionName, topicName)
 	return subscriptionName
 }
 
-// CreateASBListener function that creates a Service Bus receiver and listens to messages.
-func CreateASBListener(ctx context.Context, connStr, topicName string, messageChan chan<- Message, wg *sync.WaitGroup) {
+// DeleteSubscription removes a subscription created by a listener. A subscription that no longer
+// exists is not an error.
+func DeleteSubscription(ctx context.Context, connStr, topicName, subscriptionName string) error {
+	adminClient, err := admin.NewClientFromConnectionString(connStr, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create admin client: %w", err)
+	}
+
+	_, err = adminClient.DeleteSubscription(ctx, topicName, subscriptionName, nil)
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete subscription %s on topic %s: %w", subscriptionName, topicName, err)
+	}
+	return nil
+}
+
+// CreateASBListener function that creates a Service Bus receiver and listens to messages, logging to
+// logger. The name of the subscription it creates is passed to onSubscribe, so it can be removed on
+// teardown.
+func CreateASBListener(ctx context.Context, connStr, topicName string, messageChan chan<- Message, onSubscribe func(subscriptionName string), wg *sync.WaitGroup, logger *log.Logger) {
 	defer wg.Done()
 
 	// Create an admin client to manage topics and subscriptions.
 	adminClient, err := admin.NewClientFromConnectionString(connStr, nil)
 	if err != nil {
-		log.Fatalf("Failed to create admin client: %v", err)
+		logger.Fatalf("Failed to create admin client: %v", err)
 	}
 
 	// Create a subscription with a random name.
-	subscriptionName := createSubscription(ctx, adminClient, topicName)
+	subscriptionName := createSubscription(ctx, adminClient, topicName, logger)
+	if onSubscribe != nil {
+		onSubscribe(subscriptionName)
+	}
 
 	// Create a Service Bus client.
 	client, err := azservicebus.NewClientFromConnectionString(connStr, nil)
 	if err != nil {
-		log.Fatalf("Failed to create Service Bus client: %v", err)
+		logger.Fatalf("Failed to create Service Bus client: %v", err)
 	}
-	defer client.Close(ctx)
+	// Close with a fresh context: ctx is usually cancelled by the time the listener returns.
+	defer client.Close(context.Background())
 
 	// Create a receiver for the topic and the new subscription.
 	receiver, err := client.NewReceiverForSubscription(topicName, subscriptionName, nil)
 	if err != nil {
-		log.Fatalf("Failed to create receiver: %v", err)
+		logger.Fatalf("Failed to create receiver: %v", err)
 	}
-	defer receiver.Close(ctx)
+	defer receiver.Close(context.Background())
 
-	log.Printf("Listening on topic: %s, subscription: %s", topicName, subscriptionName)
+	logger.Printf("Listening on topic: %s, subscription: %s", topicName, subscriptionName)
+	metrics.Listeners.Inc()
+	defer metrics.Listeners.Dec()
 
 	// Continuously receive messages.
 	for {
 		msgs, err := receiver.ReceiveMessages(ctx, 1, nil)
 		if err != nil {
-			log.Printf("Error receiving message: %v", err)
+			if ctx.Err() == nil {
+				logger.Printf("Error receiving message: %v", err)
+				metrics.ReceiveErrors.WithLabelValues(topicName, "receive").Inc()
+			}
 			return
 		}
+		receivedAt := time.Now()
 
 		for _, msg := range msgs {
 			// Push the received message to the channel.
-			messageChan <- Message{Topic: topicName, Content: string(msg.Body)}
+			messageChan <- newMessage(topicName, subscriptionName, msg, receivedAt)
+			metrics.MessagesReceived.WithLabelValues(topicName).Inc()
 
 			// Complete the message to remove it from the queue.
 			if err := receiver.CompleteMessage(ctx, msg, nil); err != nil {
-				log.Printf("Failed to complete message: %v", err)
+				logger.Printf("Failed to complete message: %v", err)
+				metrics.ReceiveErrors.WithLabelValues(topicName, "complete").Inc()
 			}
 		}
 	}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"apim-multi-tenant-asb-load-test/config"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// Credential produces the Authorization header for APIM calls.
+type Credential interface {
+	// Authorization returns the value of the Authorization header.
+	Authorization(ctx context.Context) (string, error)
+	// Invalidate discards a cached token after APIM rejected the header it returned, so the next call
+	// fetches a new one.
+	Invalidate(header string)
+}
+
+// static is a credential whose header never changes.
+type static string
+
+func (s static) Authorization(context.Context) (string, error) { return string(s), nil }
+
+func (s static) Invalidate(string) {}
+
+// Bearer returns a credential for a fixed bearer token.
+func Bearer(token string) Credential {
+	return static("Bearer " + token)
+}
+
+// Basic returns a credential for base64 encoded basic credentials.
+func Basic(encoded string) Credential {
+	return static("Basic " + encoded)
+}
+
+// Admin returns the credential for the admin and internal APIs described by cfg: the basic token, or
+// the OAuth2 username and password when no token is configured.
+func Admin(cfg config.APIMConfig) Credential {
+	if cfg.BasicAuthToken == "" && cfg.OAuth2.Username != "" {
+		return Basic(base64.StdEncoding.EncodeToString([]byte(cfg.OAuth2.Username + ":" + cfg.OAuth2.Password)))
+	}
+	return Basic(cfg.BasicAuthToken)
+}
+
+// Publisher returns the credential for the publisher API described by cfg: the static token when no
+// grant type is configured, otherwise an OAuth2 provider that obtains tokens from APIM.
+func Publisher(cfg config.APIMConfig, client *http.Client) (Credential, error) {
+	switch cfg.OAuth2.GrantType {
+	case "":
+		return Bearer(cfg.AuthToken), nil
+	case GrantClientCredentials, GrantPassword:
+		return NewOAuth2(cfg.BaseURL, cfg.OAuth2, client), nil
+	default:
+		return nil, fmt.Errorf("unsupported grant type %q", cfg.OAuth2.GrantType)
+	}
+}
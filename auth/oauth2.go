@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"apim-multi-tenant-asb-load-test/config"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+
+	tokenPath = "/oauth2/token"
+	dcrPath   = "/client-registration/v0.17/register"
+
+	// defaultLifetime is assumed for tokens whose response doesn't say when they expire. A token that
+	// expires sooner is replaced when APIM rejects it.
+	defaultLifetime = time.Hour
+)
+
+// DefaultScopes are requested when the config doesn't list any.
+var DefaultScopes = []string{"apim:api_view", "apim:api_create", "apim:api_publish", "apim:api_delete", "apim:api_manage"}
+
+// OAuth2 obtains publisher tokens from the APIM token endpoint and refreshes them before they expire.
+// Without a configured client it registers one through dynamic client registration first.
+type OAuth2 struct {
+	cfg      config.OAuth2Config
+	tokenURL string
+	dcrURL   string
+	client   *http.Client
+
+	// clientID, clientSecret and refreshToken are only used by the fetch in flight.
+	clientID     string
+	clientSecret string
+	refreshToken string
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+	// fetching is the fetch in flight, if any, which every caller that needs a token waits for.
+	fetching *flight
+}
+
+// flight is a token fetch shared by the callers that wait for it.
+type flight struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// tokenResponse represents the structure of the token endpoint response.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// dcrResponse represents the structure of the client registration response.
+type dcrResponse struct {
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+}
+
+// NewOAuth2 returns a provider for the APIM cluster at baseURL.
+func NewOAuth2(baseURL string, cfg config.OAuth2Config, client *http.Client) *OAuth2 {
+	baseURL = strings.TrimRight(baseURL, "/")
+	o := &OAuth2{
+		cfg:          cfg,
+		tokenURL:     cfg.TokenURL,
+		dcrURL:       cfg.DCRURL,
+		client:       client,
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+	}
+	if o.tokenURL == "" {
+		o.tokenURL = baseURL + tokenPath
+	}
+	if o.dcrURL == "" {
+		o.dcrURL = baseURL + dcrPath
+	}
+	return o
+}
+
+// Authorization returns a bearer header with a cached token, fetching a new one when the cached
+// token is missing or about to expire. Concurrent callers share a single fetch.
+func (o *OAuth2) Authorization(ctx context.Context) (string, error) {
+	for {
+		o.mu.Lock()
+		if o.accessToken != "" && time.Now().Add(o.cfg.RefreshBefore).Before(o.expiry) {
+			header := "Bearer " + o.accessToken
+			o.mu.Unlock()
+			return header, nil
+		}
+		f := o.fetching
+		if f == nil {
+			f = &flight{done: make(chan struct{})}
+			o.fetching = f
+			// The fetch serves every waiting caller, so it doesn't stop when this one gives up.
+			go o.fetch(context.WithoutCancel(ctx), f)
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if f.err != nil {
+			return "", f.err
+		}
+		// The fetched token is used even if it expires within RefreshBefore, unless it was
+		// invalidated in the meantime.
+		o.mu.Lock()
+		current := o.accessToken
+		o.mu.Unlock()
+		if current == f.token {
+			return "Bearer " + f.token, nil
+		}
+	}
+}
+
+// Invalidate drops the cached access token if header still carries it, so callers that were rejected
+// with the same token only cause one new fetch.
+func (o *OAuth2) Invalidate(header string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if header == "Bearer "+o.accessToken {
+		o.accessToken = ""
+	}
+}
+
+// fetch obtains a new access token for f, preferring the refresh token grant when a refresh token is
+// held, and caches it.
+func (o *OAuth2) fetch(ctx context.Context, f *flight) {
+	token, err := o.requestNewToken(ctx)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err == nil {
+		o.accessToken = token.AccessToken
+		lifetime := defaultLifetime
+		if token.ExpiresIn > 0 {
+			lifetime = time.Duration(token.ExpiresIn) * time.Second
+		}
+		o.expiry = time.Now().Add(lifetime)
+		f.token = token.AccessToken
+	}
+	f.err = err
+	o.fetching = nil
+	close(f.done)
+}
+
+func (o *OAuth2) requestNewToken(ctx context.Context) (tokenResponse, error) {
+	if o.clientID == "" {
+		if err := o.register(ctx); err != nil {
+			return tokenResponse{}, err
+		}
+	}
+
+	if o.refreshToken != "" {
+		form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {o.refreshToken}}
+		if token, err := o.requestToken(ctx, form); err == nil {
+			return token, nil
+		}
+		// The refresh token may have expired too, fall back to the configured grant.
+		o.refreshToken = ""
+	}
+
+	form := url.Values{"grant_type": {o.cfg.GrantType}, "scope": {strings.Join(o.scopes(), " ")}}
+	if o.cfg.GrantType == GrantPassword {
+		form.Set("username", o.cfg.Username)
+		form.Set("password", o.cfg.Password)
+	}
+	return o.requestToken(ctx, form)
+}
+
+// requestToken posts form to the token endpoint and returns the tokens, keeping the refresh token.
+func (o *OAuth2) requestToken(ctx context.Context, form url.Values) (tokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(o.clientID, o.clientSecret)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return tokenResponse{}, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return tokenResponse{}, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return tokenResponse{}, fmt.Errorf("token response has no access token")
+	}
+	if token.RefreshToken != "" {
+		o.refreshToken = token.RefreshToken
+	}
+	return token, nil
+}
+
+// register creates an OAuth2 client through dynamic client registration, authenticating with the
+// configured username and password.
+func (o *OAuth2) register(ctx context.Context) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"callbackUrl": "www.loadtest.com",
+		"clientName":  o.cfg.ClientName,
+		"owner":       o.cfg.Username,
+		"grantType":   "client_credentials password refresh_token",
+		"saasApp":     true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.dcrURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create registration request: %w", err)
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(o.cfg.Username + ":" + o.cfg.Password))
+	req.Header.Set("Authorization", "Basic "+credentials)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("registration request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("registration request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var client dcrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&client); err != nil {
+		return fmt.Errorf("failed to parse registration response: %w", err)
+	}
+	o.clientID, o.clientSecret = client.ClientID, client.ClientSecret
+	return nil
+}
+
+func (o *OAuth2) scopes() []string {
+	if len(o.cfg.Scopes) > 0 {
+		return o.cfg.Scopes
+	}
+	return DefaultScopes
+}
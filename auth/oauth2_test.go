@@ -0,0 +1,328 @@
+package auth_test
+
+import (
+	"apim-multi-tenant-asb-load-test/apis"
+	"apim-multi-tenant-asb-load-test/auth"
+	"apim-multi-tenant-asb-load-test/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is an APIM token and registration endpoint that hands out numbered tokens.
+type tokenServer struct {
+	*httptest.Server
+
+	// expiresIn is the lifetime of the tokens, left out of the response if zero, refreshFails makes
+	// the refresh token grant fail and delay slows down every token response.
+	expiresIn    int
+	refreshFails bool
+	delay        time.Duration
+
+	mu       sync.Mutex
+	issued   int
+	grants   []string
+	forms    []map[string]string
+	clientID string
+	// registrations counts the clients registered through DCR.
+	registrations int
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	s := &tokenServer{expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", s.token)
+	mux.HandleFunc("/client-registration/v0.17/register", s.register)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, _, _ := r.BasicAuth()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant := r.PostForm.Get("grant_type")
+	s.grants = append(s.grants, grant)
+	form := map[string]string{"client_id": clientID}
+	for key := range r.PostForm {
+		form[key] = r.PostForm.Get(key)
+	}
+	s.forms = append(s.forms, form)
+
+	if grant == "refresh_token" && s.refreshFails {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	time.Sleep(s.delay)
+	s.issued++
+	token := map[string]any{
+		"access_token":  fmt.Sprintf("token-%d", s.issued),
+		"refresh_token": fmt.Sprintf("refresh-%d", s.issued),
+	}
+	if s.expiresIn != 0 {
+		token["expires_in"] = s.expiresIn
+	}
+	json.NewEncoder(w).Encode(token)
+}
+
+func (s *tokenServer) register(w http.ResponseWriter, r *http.Request) {
+	username, password, _ := r.BasicAuth()
+	if username != "admin" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registrations++
+	s.clientID = fmt.Sprintf("client-%d", s.registrations)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"clientId": s.clientID, "clientSecret": "client-secret"})
+}
+
+func (s *tokenServer) requests() ([]string, []map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.grants...), append([]map[string]string(nil), s.forms...)
+}
+
+func authorization(t *testing.T, cred auth.Credential) string {
+	t.Helper()
+	header, err := cred.Authorization(context.Background())
+	if err != nil {
+		t.Fatalf("Authorization: %v", err)
+	}
+	return header
+}
+
+func TestOAuth2Grants(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.OAuth2Config
+		want map[string]string
+	}{
+		{
+			name: "client credentials",
+			cfg:  config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret"},
+			want: map[string]string{"grant_type": "client_credentials", "client_id": "id", "scope": "apim:api_view apim:api_create apim:api_publish apim:api_delete apim:api_manage"},
+		},
+		{
+			name: "password",
+			cfg: config.OAuth2Config{
+				GrantType: auth.GrantPassword, ClientID: "id", ClientSecret: "secret",
+				Username: "admin", Password: "secret", Scopes: []string{"apim:api_view"},
+			},
+			want: map[string]string{"grant_type": "password", "client_id": "id", "username": "admin", "password": "secret", "scope": "apim:api_view"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTokenServer(t)
+			cred := auth.NewOAuth2(server.URL, tt.cfg, server.Client())
+
+			if got := authorization(t, cred); got != "Bearer token-1" {
+				t.Errorf("Authorization = %q, want %q", got, "Bearer token-1")
+			}
+			// The token is cached until it is about to expire.
+			if got := authorization(t, cred); got != "Bearer token-1" {
+				t.Errorf("second Authorization = %q, want %q", got, "Bearer token-1")
+			}
+
+			_, forms := server.requests()
+			if len(forms) != 1 {
+				t.Fatalf("token requests = %d, want 1", len(forms))
+			}
+			for key, want := range tt.want {
+				if got := forms[0][key]; got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOAuth2RegistersClient(t *testing.T) {
+	server := newTokenServer(t)
+	cfg := config.OAuth2Config{GrantType: auth.GrantPassword, Username: "admin", Password: "secret"}
+	cred := auth.NewOAuth2(server.URL, cfg, server.Client())
+
+	if got := authorization(t, cred); got != "Bearer token-1" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token-1")
+	}
+	cred.Invalidate("Bearer token-1")
+	authorization(t, cred)
+
+	if server.registrations != 1 {
+		t.Errorf("registrations = %d, want 1", server.registrations)
+	}
+	_, forms := server.requests()
+	for i, form := range forms {
+		if form["client_id"] != "client-1" {
+			t.Errorf("token request %d client_id = %q, want the registered client-1", i, form["client_id"])
+		}
+	}
+}
+
+func TestOAuth2RefreshesBeforeExpiry(t *testing.T) {
+	server := newTokenServer(t)
+	server.expiresIn = 60
+	cfg := config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret", RefreshBefore: time.Minute}
+	cred := auth.NewOAuth2(server.URL, cfg, server.Client())
+
+	if got := authorization(t, cred); got != "Bearer token-1" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token-1")
+	}
+	// The token expires within RefreshBefore, so it is refreshed on the next call.
+	if got := authorization(t, cred); got != "Bearer token-2" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token-2")
+	}
+
+	grants, forms := server.requests()
+	if want := []string{"client_credentials", "refresh_token"}; fmt.Sprint(grants) != fmt.Sprint(want) {
+		t.Errorf("grants = %v, want %v", grants, want)
+	}
+	if got := forms[1]["refresh_token"]; got != "refresh-1" {
+		t.Errorf("refresh_token = %q, want %q", got, "refresh-1")
+	}
+}
+
+func TestOAuth2FallsBackFromFailedRefresh(t *testing.T) {
+	server := newTokenServer(t)
+	server.expiresIn = 60
+	server.refreshFails = true
+	cfg := config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret", RefreshBefore: time.Minute}
+	cred := auth.NewOAuth2(server.URL, cfg, server.Client())
+
+	authorization(t, cred)
+	if got := authorization(t, cred); got != "Bearer token-2" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token-2")
+	}
+
+	grants, _ := server.requests()
+	if want := []string{"client_credentials", "refresh_token", "client_credentials"}; fmt.Sprint(grants) != fmt.Sprint(want) {
+		t.Errorf("grants = %v, want %v", grants, want)
+	}
+}
+
+func TestOAuth2SharesFetch(t *testing.T) {
+	server := newTokenServer(t)
+	server.delay = 50 * time.Millisecond
+	cfg := config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret", RefreshBefore: time.Minute}
+	cred := auth.NewOAuth2(server.URL, cfg, server.Client())
+
+	var wg sync.WaitGroup
+	headers := make([]string, 20)
+	for i := range headers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			headers[i] = authorization(t, cred)
+		}()
+	}
+	wg.Wait()
+
+	for i, header := range headers {
+		if header != "Bearer token-1" {
+			t.Errorf("Authorization %d = %q, want %q", i, header, "Bearer token-1")
+		}
+	}
+	if grants, _ := server.requests(); len(grants) != 1 {
+		t.Errorf("token requests = %v, want one", grants)
+	}
+}
+
+func TestOAuth2WithoutExpiry(t *testing.T) {
+	server := newTokenServer(t)
+	server.expiresIn = 0
+	cfg := config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret", RefreshBefore: time.Minute}
+	cred := auth.NewOAuth2(server.URL, cfg, server.Client())
+
+	authorization(t, cred)
+	if got := authorization(t, cred); got != "Bearer token-1" {
+		t.Errorf("Authorization = %q, want the cached %q", got, "Bearer token-1")
+	}
+}
+
+func TestOAuth2InvalidatesOnlyTheRejectedToken(t *testing.T) {
+	server := newTokenServer(t)
+	cfg := config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret"}
+	cred := auth.NewOAuth2(server.URL, cfg, server.Client())
+
+	rejected := authorization(t, cred)
+	cred.Invalidate(rejected)
+	if got := authorization(t, cred); got != "Bearer token-2" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token-2")
+	}
+	// A caller rejected with the old token doesn't drop the new one.
+	cred.Invalidate(rejected)
+	if got := authorization(t, cred); got != "Bearer token-2" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token-2")
+	}
+}
+
+func TestClientRetriesOnceAfterUnauthorized(t *testing.T) {
+	tests := []struct {
+		name string
+		// rejected is the number of requests the API answers with 401.
+		rejected   int
+		wantErr    bool
+		wantTokens []string
+	}{
+		{name: "expired token", rejected: 1, wantTokens: []string{"Bearer token-1", "Bearer token-2"}},
+		{name: "rejected twice", rejected: 2, wantErr: true, wantTokens: []string{"Bearer token-1", "Bearer token-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTokenServer(t)
+
+			var mu sync.Mutex
+			var tokens []string
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				tokens = append(tokens, r.Header.Get("Authorization"))
+				if len(tokens) <= tt.rejected {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(map[string]string{"id": "revision-1"})
+			}))
+			defer api.Close()
+
+			cfg := config.APIMConfig{
+				BaseURL: api.URL,
+				OAuth2:  config.OAuth2Config{GrantType: auth.GrantClientCredentials, ClientID: "id", ClientSecret: "secret", TokenURL: server.URL + "/oauth2/token"},
+				Retry:   config.RetryConfig{MaxAttempts: 3},
+			}
+			publisher, err := auth.Publisher(cfg, server.Client())
+			if err != nil {
+				t.Fatalf("Publisher: %v", err)
+			}
+			client := apis.NewClient(cfg, api.Client(), publisher, auth.Basic(""), log.Default())
+
+			revisionID, err := client.CreateRevision(context.Background(), "api", "org", "revision")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("CreateRevision succeeded, want an error")
+				}
+			} else if err != nil || revisionID != "revision-1" {
+				t.Errorf("CreateRevision = %q, %v, want revision-1", revisionID, err)
+			}
+			if fmt.Sprint(tokens) != fmt.Sprint(tt.wantTokens) {
+				t.Errorf("tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything a load test run needs to know about the target cluster and its scale.
+type Config struct {
+	APIM              APIMConfig      `yaml:"apim"`
+	Tenants           int             `yaml:"tenants"`
+	Parallelism       int             `yaml:"parallelism"`
+	Revisions         RevisionsConfig `yaml:"revisions"`
+	Workload          WorkloadConfig  `yaml:"workload"`
+	DeployConcurrency int             `yaml:"deployConcurrency"`
+	Messaging         MessagingConfig `yaml:"messaging"`
+	Metrics           MetricsConfig   `yaml:"metrics"`
+	// Dashboard shows the progress of a run on the terminal, which then gets no other output until
+	// the run ends; it goes to Files.RunLog instead.
+	Dashboard bool        `yaml:"dashboard"`
+	Files     FilesConfig `yaml:"files"`
+}
+
+// APIMConfig describes the APIM cluster under test.
+type APIMConfig struct {
+	BaseURL string `yaml:"baseUrl"`
+	// AuthToken is a static publisher token, used when no OAuth2 grant type is configured.
+	AuthToken string `yaml:"authToken"`
+	// BasicAuthToken is the base64 encoded basic credentials for the admin and internal APIs. Without
+	// it they are called with the OAuth2 username and password.
+	BasicAuthToken string       `yaml:"basicAuthToken"`
+	OAuth2         OAuth2Config `yaml:"oauth2"`
+	// Timeout bounds a single HTTP request to APIM, including reading the response.
+	Timeout time.Duration `yaml:"timeout"`
+	Retry   RetryConfig   `yaml:"retry"`
+	TLS     TLSConfig     `yaml:"tls"`
+}
+
+// TLSConfig controls how APIM's certificates are verified and which client certificate is offered.
+type TLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile are the client certificate for mTLS, as required by the internal
+	// dataplanes endpoint on some clusters. It is only sent to servers that ask for one.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ServerName overrides the SNI and the name verified in the server certificate.
+	ServerName string `yaml:"serverName"`
+	// Insecure disables certificate verification. Only meant for local clusters.
+	Insecure bool `yaml:"insecure"`
+}
+
+// RetryConfig controls how transient APIM failures (429, 502, 503, 504) are retried. Delays grow
+// exponentially from BaseDelay with full jitter, capped at MaxDelay, unless APIM sends Retry-After.
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"maxAttempts"`
+	BaseDelay   time.Duration `yaml:"baseDelay"`
+	MaxDelay    time.Duration `yaml:"maxDelay"`
+}
+
+// OAuth2Config describes how publisher tokens are obtained from the APIM token endpoint. A client is
+// registered through dynamic client registration when no client ID is given.
+type OAuth2Config struct {
+	// GrantType is client_credentials or password. Empty means the static AuthToken is used.
+	GrantType     string        `yaml:"grantType"`
+	TokenURL      string        `yaml:"tokenUrl"`
+	DCRURL        string        `yaml:"dcrUrl"`
+	ClientName    string        `yaml:"clientName"`
+	ClientID      string        `yaml:"clientId"`
+	ClientSecret  string        `yaml:"clientSecret"`
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	Scopes        []string      `yaml:"scopes"`
+	RefreshBefore time.Duration `yaml:"refreshBefore"`
+}
+
+// WorkloadConfig describes when deployments are issued during a run. Arrivals follow the configured
+// rate regardless of how fast APIM responds; DeployConcurrency only caps the requests in flight.
+type WorkloadConfig struct {
+	// Arrival is constant, poisson or schedule.
+	Arrival string `yaml:"arrival"`
+	// Rate is the target number of deployments per second for constant and poisson arrivals.
+	Rate float64 `yaml:"rate"`
+	// Schedule lists the offsets from the start of the run at which deployments are issued in
+	// schedule mode. ScheduleFile does the same with one offset per line.
+	Schedule     []time.Duration `yaml:"schedule"`
+	ScheduleFile string          `yaml:"scheduleFile"`
+	// Duration bounds a run at Rate. Zero runs until interrupted. Ignored when Profile is set.
+	Duration time.Duration `yaml:"duration"`
+	// Profile replaces Rate and Duration with a sequence of segments, e.g. a ramp, a hold and a spike.
+	Profile []ProfileSegment `yaml:"profile"`
+	// Operations weighs the operations issued at each arrival.
+	Operations OperationsConfig `yaml:"operations"`
+	// Selection picks the tenant each deployment goes to.
+	Selection SelectionConfig `yaml:"selection"`
+	// Seed makes random arrivals and tenant selection reproducible. Zero seeds from the clock.
+	Seed int64 `yaml:"seed"`
+	// ReportInterval is how often the achieved rate is logged during a run.
+	ReportInterval time.Duration `yaml:"reportInterval"`
+}
+
+// OperationsConfig holds the relative weights of the operations in the workload mix.
+type OperationsConfig struct {
+	Deploy   float64 `yaml:"deploy"`
+	Undeploy float64 `yaml:"undeploy"`
+	// Update changes the API definition and creates a revision from it.
+	Update float64 `yaml:"update"`
+	// Lifecycle alternates the API between PUBLISHED and DEPRECATED.
+	Lifecycle float64 `yaml:"lifecycle"`
+	// Delete creates a scratch API for the tenant and deletes it.
+	Delete float64 `yaml:"delete"`
+}
+
+// SelectionConfig decides which tenant each deployment goes to.
+type SelectionConfig struct {
+	// Strategy is round-robin, random, weighted, zipf or hot.
+	Strategy string `yaml:"strategy"`
+	// Weights maps org IDs to relative weights for the weighted strategy. Unlisted tenants get
+	// DefaultWeight.
+	Weights       map[string]float64 `yaml:"weights"`
+	DefaultWeight float64            `yaml:"defaultWeight"`
+	// ZipfExponent is the skew of the zipf strategy and must be greater than 1.
+	ZipfExponent float64 `yaml:"zipfExponent"`
+	// HotFraction of the tenants receive HotShare of the deployments with the hot strategy.
+	HotFraction float64 `yaml:"hotFraction"`
+	HotShare    float64 `yaml:"hotShare"`
+}
+
+// RevisionsConfig sets how many revisions create-apis keeps per API. Deployments rotate through
+// them, so every deployment changes what the gateway serves.
+type RevisionsConfig struct {
+	PerAPI int `yaml:"perApi"`
+	// Limit is the number of revisions APIM allows per API, which PerAPI must not exceed. Update
+	// operations delete the oldest undeployed revision before creating one once an API holds Limit
+	// revisions. Whenever APIM reports the limit reached anyway, the same happens after the fact.
+	Limit int `yaml:"limit"`
+}
+
+// ProfileSegment is one phase of a load profile. The rate changes linearly from From to To over the
+// segment; setting Rate holds it constant instead.
+type ProfileSegment struct {
+	Name     string        `yaml:"name"`
+	Duration time.Duration `yaml:"duration"`
+	Rate     float64       `yaml:"rate"`
+	From     float64       `yaml:"from"`
+	To       float64       `yaml:"to"`
+}
+
+// MessagingConfig controls how gateway events are received and classified.
+type MessagingConfig struct {
+	BufferSize    int           `yaml:"bufferSize"`
+	LateThreshold time.Duration `yaml:"lateThreshold"`
+	// DrainWindow is how long events are still received after the last deployment was issued.
+	// Deployments whose event hasn't arrived by then are reported as lost.
+	DrainWindow time.Duration `yaml:"drainWindow"`
+	// ExpireAfter is how long an operation waits for its event before it is reported as lost. Matched
+	// operations are remembered as long to recognize duplicate events.
+	ExpireAfter time.Duration `yaml:"expireAfter"`
+}
+
+// MetricsConfig controls the Prometheus endpoint exposed while the load test runs.
+type MetricsConfig struct {
+	// Address is where /metrics is served, e.g. "localhost:9090" or ":9090" for every interface.
+	// Empty, the default, disables the endpoint.
+	Address string `yaml:"address"`
+}
+
+// FilesConfig names the run state file shared between phases and the files results are written to.
+type FilesConfig struct {
+	State string `yaml:"state"`
+	// Results gets one record per operation and per received event, in ResultsFormat: jsonl or csv.
+	Results           string `yaml:"results"`
+	ResultsFormat     string `yaml:"resultsFormat"`
+	LostDeployments   string `yaml:"lostDeployments"`
+	TenantDeployments string `yaml:"tenantDeployments"`
+	LatencyReport     string `yaml:"latencyReport"`
+	// Leaks gets the events that arrived on a topic of another tenant than the one that owns their API.
+	Leaks string `yaml:"leaks"`
+	// RunLog gets the output of a run while the dashboard is shown.
+	RunLog string `yaml:"runLog"`
+	// HTMLReport gets a self-contained report of the run built from Results.
+	HTMLReport string `yaml:"htmlReport"`
+}
+
+// Default returns the configuration used when no file, environment variable or flag overrides a value.
+func Default() *Config {
+	return &Config{
+		APIM: APIMConfig{
+			BaseURL: "https://localhost:9444",
+			OAuth2: OAuth2Config{
+				ClientName:    "apim-multi-tenant-load-test",
+				RefreshBefore: time.Minute,
+			},
+			Timeout: 30 * time.Second,
+			Retry: RetryConfig{
+				MaxAttempts: 4,
+				BaseDelay:   500 * time.Millisecond,
+				MaxDelay:    10 * time.Second,
+			},
+		},
+		Tenants:     500,
+		Parallelism: 10,
+		Revisions: RevisionsConfig{
+			PerAPI: 3,
+			Limit:  5,
+		},
+		DeployConcurrency: 70,
+		Workload: WorkloadConfig{
+			Arrival:        "constant",
+			Rate:           30,
+			ReportInterval: 10 * time.Second,
+			Operations:     OperationsConfig{Deploy: 1},
+			Selection: SelectionConfig{
+				Strategy:      "round-robin",
+				DefaultWeight: 1,
+				ZipfExponent:  1.1,
+				HotFraction:   0.05,
+				HotShare:      0.8,
+			},
+		},
+		Messaging: MessagingConfig{
+			BufferSize:    20,
+			LateThreshold: time.Minute,
+			DrainWindow:   30 * time.Second,
+			ExpireAfter:   5 * time.Minute,
+		},
+		Files: FilesConfig{
+			State:             "run_state.json",
+			Results:           "results.jsonl",
+			ResultsFormat:     "jsonl",
+			LostDeployments:   "lost_deployments.txt",
+			TenantDeployments: "tenant_deployments.csv",
+			LatencyReport:     "latency_report.txt",
+			Leaks:             "leaked_events.txt",
+			RunLog:            "run.log",
+			HTMLReport:        "report.html",
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the optional config file, environment variables and
+// command line flags, in increasing order of precedence. The flags are registered on fs, so callers
+// can add their own flags before calling Load.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	path := fs.String("config", os.Getenv("LOADTEST_CONFIG"), "path to a YAML or JSON config file")
+	baseURL := fs.String("base-url", "", "APIM base URL, e.g. https://localhost:9444")
+	authToken := fs.String("auth-token", "", "bearer token for the publisher API")
+	statePath := fs.String("state", "", "path to the run state file")
+	grantType := fs.String("grant-type", "", "OAuth2 grant type for publisher tokens: client_credentials or password")
+	basicAuthToken := fs.String("basic-auth-token", "", "base64 encoded basic credentials for the admin and internal APIs")
+	insecure := fs.Bool("insecure", false, "skip verification of APIM's TLS certificate")
+	tenants := fs.Int("tenants", 0, "number of tenants (org/dataplane pairs) to provision")
+	parallelism := fs.Int("parallelism", 0, "maximum parallel provisioning requests")
+	arrival := fs.String("arrival", "", "deployment arrival process: constant, poisson or schedule")
+	rate := fs.Float64("rate", 0, "target deployments per second")
+	duration := fs.Duration("duration", 0, "how long to deploy at -rate, 0 runs until interrupted")
+	selection := fs.String("selection", "", "tenant selection strategy: round-robin, random, weighted, zipf or hot")
+	drainWindow := fs.Duration("drain-window", 0, "how long to keep receiving events after the last deployment")
+	expireAfter := fs.Duration("expire-after", 0, "how long an operation waits for its event before it is reported as lost")
+	seed := fs.Int64("seed", 0, "seed for random arrivals and tenant selection, 0 seeds from the clock")
+	revisions := fs.Int("revisions", 0, "revisions to create per API")
+	deployConcurrency := fs.Int("deploy-concurrency", 0, "maximum concurrent deployments")
+	metricsAddress := fs.String("metrics-address", "", "address to serve Prometheus metrics on, empty to disable")
+	dashboard := fs.Bool("dashboard", false, "show a live dashboard instead of the run's output")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// YAML is a superset of JSON, so the same decoder handles both formats.
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", *path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "base-url":
+			cfg.APIM.BaseURL = *baseURL
+		case "auth-token":
+			cfg.APIM.AuthToken = *authToken
+		case "grant-type":
+			cfg.APIM.OAuth2.GrantType = *grantType
+		case "basic-auth-token":
+			cfg.APIM.BasicAuthToken = *basicAuthToken
+		case "insecure":
+			cfg.APIM.TLS.Insecure = *insecure
+		case "state":
+			cfg.Files.State = *statePath
+		case "tenants":
+			cfg.Tenants = *tenants
+		case "parallelism":
+			cfg.Parallelism = *parallelism
+		case "revisions":
+			cfg.Revisions.PerAPI = *revisions
+		case "deploy-concurrency":
+			cfg.DeployConcurrency = *deployConcurrency
+		case "arrival":
+			cfg.Workload.Arrival = *arrival
+		case "rate":
+			cfg.Workload.Rate = *rate
+		case "duration":
+			cfg.Workload.Duration = *duration
+		case "selection":
+			cfg.Workload.Selection.Strategy = *selection
+		case "drain-window":
+			cfg.Messaging.DrainWindow = *drainWindow
+		case "expire-after":
+			cfg.Messaging.ExpireAfter = *expireAfter
+		case "metrics-address":
+			cfg.Metrics.Address = *metricsAddress
+		case "dashboard":
+			cfg.Dashboard = *dashboard
+		case "seed":
+			cfg.Workload.Seed = *seed
+		}
+	})
+
+	for i := range cfg.Workload.Profile {
+		segment := &cfg.Workload.Profile[i]
+		if segment.Rate != 0 {
+			segment.From, segment.To = segment.Rate, segment.Rate
+		}
+		if segment.Name == "" {
+			segment.Name = fmt.Sprintf("segment-%d", i+1)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides values from LOADTEST_* and APIM_* environment variables.
+func (c *Config) applyEnv() error {
+	setString := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	setInt := func(name string, dst *int) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		*dst = n
+		return nil
+	}
+
+	setString("APIM_BASE_URL", &c.APIM.BaseURL)
+	setString("APIM_AUTH_TOKEN", &c.APIM.AuthToken)
+	setString("APIM_BASIC_AUTH_TOKEN", &c.APIM.BasicAuthToken)
+	setString("APIM_GRANT_TYPE", &c.APIM.OAuth2.GrantType)
+	setString("APIM_CLIENT_ID", &c.APIM.OAuth2.ClientID)
+	setString("APIM_CLIENT_SECRET", &c.APIM.OAuth2.ClientSecret)
+	setString("APIM_USERNAME", &c.APIM.OAuth2.Username)
+	setString("APIM_PASSWORD", &c.APIM.OAuth2.Password)
+	setString("LOADTEST_STATE", &c.Files.State)
+	setString("LOADTEST_METRICS_ADDRESS", &c.Metrics.Address)
+	if v, ok := os.LookupEnv("APIM_TLS_INSECURE"); ok {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for APIM_TLS_INSECURE: %w", err)
+		}
+		c.APIM.TLS.Insecure = insecure
+	}
+	if err := setInt("LOADTEST_TENANTS", &c.Tenants); err != nil {
+		return err
+	}
+	if err := setInt("LOADTEST_PARALLELISM", &c.Parallelism); err != nil {
+		return err
+	}
+	if err := setInt("LOADTEST_REVISIONS", &c.Revisions.PerAPI); err != nil {
+		return err
+	}
+	return setInt("LOADTEST_DEPLOY_CONCURRENCY", &c.DeployConcurrency)
+}
+
+// Redacted returns the configuration as YAML with its credentials replaced, to be shared in reports.
+func (c *Config) Redacted() (string, error) {
+	redacted := *c
+	for _, secret := range []*string{
+		&redacted.APIM.AuthToken,
+		&redacted.APIM.BasicAuthToken,
+		&redacted.APIM.OAuth2.ClientSecret,
+		&redacted.APIM.OAuth2.Password,
+	} {
+		if *secret != "" {
+			*secret = "<redacted>"
+		}
+	}
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return string(data), nil
+}
+
+// ValidateAdmin reports missing credentials for the admin and internal APIs, for the commands that
+// call them.
+func (c *Config) ValidateAdmin() error {
+	if c.APIM.BasicAuthToken == "" && c.APIM.OAuth2.Username == "" {
+		return fmt.Errorf("apim.basicAuthToken or apim.oauth2.username must be set for the admin and internal APIs")
+	}
+	return nil
+}
+
+// Validate reports the first setting that would make a run misbehave.
+func (c *Config) Validate() error {
+	switch {
+	case c.APIM.BaseURL == "":
+		return fmt.Errorf("apim.baseUrl must be set")
+	case c.APIM.OAuth2.GrantType == "password" && c.APIM.OAuth2.Username == "":
+		return fmt.Errorf("apim.oauth2.username must be set for the password grant")
+	case c.APIM.OAuth2.GrantType != "" && c.APIM.OAuth2.ClientID == "" && c.APIM.OAuth2.Username == "":
+		return fmt.Errorf("apim.oauth2 needs a clientId or a username for client registration")
+	case c.APIM.Retry.MaxAttempts <= 0:
+		return fmt.Errorf("apim.retry.maxAttempts must be positive, got %d", c.APIM.Retry.MaxAttempts)
+	case (c.APIM.TLS.CertFile == "") != (c.APIM.TLS.KeyFile == ""):
+		return fmt.Errorf("apim.tls.certFile and apim.tls.keyFile must be set together")
+	case c.Files.State == "":
+		return fmt.Errorf("files.state must be set")
+	case c.Tenants <= 0:
+		return fmt.Errorf("tenants must be positive, got %d", c.Tenants)
+	case c.Parallelism <= 0:
+		return fmt.Errorf("parallelism must be positive, got %d", c.Parallelism)
+	case c.Revisions.PerAPI <= 0:
+		return fmt.Errorf("revisions.perApi must be positive, got %d", c.Revisions.PerAPI)
+	case c.Revisions.Limit > 0 && c.Revisions.PerAPI > c.Revisions.Limit:
+		return fmt.Errorf("revisions.perApi must not exceed revisions.limit (%d), got %d", c.Revisions.Limit, c.Revisions.PerAPI)
+	case c.DeployConcurrency <= 0:
+		return fmt.Errorf("deployConcurrency must be positive, got %d", c.DeployConcurrency)
+	case c.Workload.Arrival != "constant" && c.Workload.Arrival != "poisson" && c.Workload.Arrival != "schedule":
+		return fmt.Errorf("workload.arrival must be constant, poisson or schedule, got %q", c.Workload.Arrival)
+	case c.Workload.Arrival != "schedule" && len(c.Workload.Profile) == 0 && c.Workload.Rate <= 0:
+		return fmt.Errorf("workload.rate must be positive, got %g", c.Workload.Rate)
+	case c.Workload.Arrival == "schedule" && len(c.Workload.Schedule) == 0 && c.Workload.ScheduleFile == "":
+		return fmt.Errorf("workload.schedule or workload.scheduleFile must be set for schedule arrivals")
+	case c.Workload.Operations.Deploy < 0 || c.Workload.Operations.Undeploy < 0 || c.Workload.Operations.Update < 0 ||
+		c.Workload.Operations.Lifecycle < 0 || c.Workload.Operations.Delete < 0:
+		return fmt.Errorf("workload.operations weights must not be negative")
+	case c.Workload.Operations.Deploy+c.Workload.Operations.Undeploy+c.Workload.Operations.Update+
+		c.Workload.Operations.Lifecycle+c.Workload.Operations.Delete <= 0:
+		return fmt.Errorf("workload.operations must give at least one operation a positive weight")
+	case c.Workload.Selection.Strategy == "zipf" && c.Workload.Selection.ZipfExponent <= 1:
+		return fmt.Errorf("workload.selection.zipfExponent must be greater than 1, got %g", c.Workload.Selection.ZipfExponent)
+	case c.Workload.Selection.Strategy == "hot" && (c.Workload.Selection.HotFraction <= 0 || c.Workload.Selection.HotFraction >= 1):
+		return fmt.Errorf("workload.selection.hotFraction must be between 0 and 1, got %g", c.Workload.Selection.HotFraction)
+	case c.Workload.Selection.Strategy == "hot" && (c.Workload.Selection.HotShare < 0 || c.Workload.Selection.HotShare > 1):
+		return fmt.Errorf("workload.selection.hotShare must be between 0 and 1, got %g", c.Workload.Selection.HotShare)
+	case c.Workload.Duration < 0:
+		return fmt.Errorf("workload.duration must not be negative, got %s", c.Workload.Duration)
+	case c.Workload.ReportInterval <= 0:
+		return fmt.Errorf("workload.reportInterval must be positive, got %s", c.Workload.ReportInterval)
+	case c.Files.ResultsFormat != "jsonl" && c.Files.ResultsFormat != "csv":
+		return fmt.Errorf("files.resultsFormat must be jsonl or csv, got %q", c.Files.ResultsFormat)
+	case c.Messaging.ExpireAfter <= 0:
+		return fmt.Errorf("messaging.expireAfter must be positive, got %s", c.Messaging.ExpireAfter)
+	case c.Messaging.DrainWindow < 0:
+		return fmt.Errorf("messaging.drainWindow must not be negative, got %s", c.Messaging.DrainWindow)
+	case c.Messaging.BufferSize < 0:
+		return fmt.Errorf("messaging.bufferSize must not be negative, got %d", c.Messaging.BufferSize)
+	}
+	for _, segment := range c.Workload.Profile {
+		if segment.Duration <= 0 {
+			return fmt.Errorf("workload.profile segment %s must have a positive duration", segment.Name)
+		}
+		if segment.From < 0 || segment.To < 0 {
+			return fmt.Errorf("workload.profile segment %s must not have a negative rate", segment.Name)
+		}
+	}
+	return nil
+}
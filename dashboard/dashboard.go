@@ -0,0 +1,122 @@
+package dashboard
+
+import (
+	"apim-multi-tenant-asb-load-test/messaging"
+	"apim-multi-tenant-asb-load-test/report"
+	"apim-multi-tenant-asb-load-test/worker"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// slowest is the number of tenants listed on the dashboard.
+const slowest = 10
+
+// clear moves the cursor home and clears the terminal.
+const clear = "\x1b[H\x1b[2J"
+
+// Dashboard redraws the progress of a run on a terminal every second: the rate of operations and
+// events, latency percentiles, failures by HTTP status and the slowest tenants.
+type Dashboard struct {
+	out       io.Writer
+	runID     string
+	generator *worker.Generator
+	listener  *messaging.Listener
+	collector *report.Collector
+
+	last sample
+}
+
+// sample is what the dashboard showed last, to turn counts into rates.
+type sample struct {
+	at       time.Time
+	issued   int64
+	received int
+	failures map[int]int64
+}
+
+// New returns a dashboard of run runID that draws on out, reading the operations from generator, the
+// events from listener and the latencies from collector.
+func New(out io.Writer, runID string, generator *worker.Generator, listener *messaging.Listener, collector *report.Collector) *Dashboard {
+	return &Dashboard{out: out, runID: runID, generator: generator, listener: listener, collector: collector}
+}
+
+// Run redraws the dashboard every second until ctx is done.
+func (d *Dashboard) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	d.draw(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.draw(now)
+		}
+	}
+}
+
+func (d *Dashboard) draw(now time.Time) {
+	stats := d.generator.Stats()
+	events := d.listener.Stats()
+	overall, tenants, _ := d.collector.Summaries()
+	recent := d.collector.Recent()
+
+	interval := now.Sub(d.last.at).Seconds()
+	rate := func(current, last int64) float64 {
+		if d.last.at.IsZero() || interval <= 0 {
+			return 0
+		}
+		return float64(current-last) / interval
+	}
+
+	var b bytes.Buffer
+	b.WriteString(clear)
+	fmt.Fprintf(&b, "Run %s    elapsed %s    Ctrl-C stops issuing operations\n\n", d.runID, stats.Elapsed.Round(time.Second))
+
+	fmt.Fprintf(&b, "Operations  rate %7.1f/s  target %7.1f/s  achieved %7.1f/s  in flight %d\n",
+		rate(stats.Issued, d.last.issued), stats.TargetRate, stats.AchievedRate(), stats.InFlight)
+	fmt.Fprintf(&b, "            issued %d  succeeded %d  failed %d  steps failed %d  dropped %d\n\n",
+		stats.Issued, stats.Succeeded, stats.Failed, stats.StepsFailed, stats.Dropped)
+
+	fmt.Fprintf(&b, "Events      rate %7.1f/s  received %d  matched %d  late %d  lost %d\n",
+		rate(int64(events.Received), int64(d.last.received)), events.Received, events.Matched, events.Late, overall.Lost)
+	fmt.Fprintf(&b, "            duplicate %d  redelivered %d  unmatched %d  unknown %d  leaked %d  undecodable %d\n\n",
+		events.Duplicates, events.Redelivered, events.Unmatched, events.Unknown, events.Leaked, events.Undecodable)
+
+	fmt.Fprintf(&b, "Latency     %-10s %8s %10s %10s %10s\n", "", "count", "p50", "p95", "p99")
+	fmt.Fprintf(&b, "            %-10s %8d %10s %10s %10s\n", fmt.Sprintf("last %s", report.RecentWindow), recent.Count, report.Millis(recent.P50), report.Millis(recent.P95), report.Millis(recent.P99))
+	fmt.Fprintf(&b, "            %-10s %8d %10s %10s %10s\n\n", "run", overall.Count, report.Millis(overall.P50), report.Millis(overall.P95), report.Millis(overall.P99))
+
+	fmt.Fprintf(&b, "Failures    %-8s %8s %8s %10s\n", "status", "count", "share", "rate")
+	statuses := make([]int, 0, len(stats.Failures))
+	for status := range stats.Failures {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	completed := stats.Succeeded + stats.Failed
+	for _, status := range statuses {
+		n := stats.Failures[status]
+		name := "none"
+		if status != 0 {
+			name = fmt.Sprint(status)
+		}
+		fmt.Fprintf(&b, "            %-8s %8d %7.1f%% %8.1f/s\n", name, n, 100*float64(n)/float64(max(completed, 1)), rate(n, d.last.failures[status]))
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "Slowest tenants by p99 (%d of %d)\n", min(slowest, len(tenants)), len(tenants))
+	fmt.Fprintf(&b, "            %-40s %8s %10s %10s %10s %6s %6s\n", "org", "count", "p50", "p95", "p99", "lost", "errors")
+	for _, tenant := range tenants[:min(slowest, len(tenants))] {
+		fmt.Fprintf(&b, "            %-40s %8d %10s %10s %10s %6d %6d\n",
+			tenant.Name, tenant.Count, report.Millis(tenant.P50), report.Millis(tenant.P95), report.Millis(tenant.P99), tenant.Lost, tenant.Errors)
+	}
+
+	// A terminal that went away isn't worth failing the run over.
+	d.out.Write(b.Bytes())
+
+	d.last = sample{at: now, issued: stats.Issued, received: events.Received, failures: stats.Failures}
+}
@@ -1,138 +1,105 @@
 package main
 
 import (
-	"apim-multi-tenant-asb-load-test/apis"
-	"apim-multi-tenant-asb-load-test/asb_client"
-	"apim-multi-tenant-asb-load-test/messaging"
-	"apim-multi-tenant-asb-load-test/utils"
-	"apim-multi-tenant-asb-load-test/worker"
+	"apim-multi-tenant-asb-load-test/config"
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"sync"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 )
 
-const (
-	authToken      = "17a56c85-f70b-3c83-ba8f-3cc75c50292d"
-	authTokenBasic = "YWRtaW46YWRtaW4="
+// command is a single phase of a load test run. Each phase reads the run state written by the phases
+// before it and records its own progress there, so phases can be rerun independently.
+type command struct {
+	name  string
+	usage string
+	// setup registers the command's own flags and returns the function that runs it.
+	setup func(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error
+	// admin is set for commands that call the admin and internal APIs, which need their credentials.
+	admin bool
+}
 
-	orgIDsFile = "organization_ids.txt"
-	apiIDsFile = "api_ids.txt"
-	topicsFile = "topics.txt"
-)
+var commands = []command{
+	{name: "provision", usage: "generate org/dataplane IDs and create an environment per tenant", setup: provisionCommand, admin: true},
+	{name: "register-topics", usage: "register dataplane topics for every tenant", setup: registerTopicsCommand, admin: true},
+	{name: "create-apis", usage: "create an API and its revisions for every tenant", setup: createAPIsCommand},
+	{name: "run", usage: "deploy revisions and measure gateway event latency", setup: runCommand},
+	{name: "report", usage: "build the HTML report of the last run from its results and state", setup: reportCommand},
+	{name: "teardown", usage: "remove the deployments, APIs, environments and subscriptions a run created", setup: teardownCommand, admin: true},
+	{name: "migrate-state", usage: "import organization_ids.txt, topics.txt and api_ids.txt into a state file", setup: migrateStateCommand},
+	{name: "all", usage: "run every phase in sequence", setup: allCommand, admin: true},
+}
 
 func main() {
-	utils.GenerateOrgAndDataPlaneIDs(500)
-	log.Printf("Organization IDs and Data Plane IDs generated and saved to %s\n", orgIDsFile)
-	time.Sleep(10 * time.Second)
-
-	utils.CreateEnvironmentsFromFile(orgIDsFile, authTokenBasic, 10)
-	log.Printf("Environments created and saved to %s\n", topicsFile)
-	time.Sleep(10 * time.Second)
-
-	if err := apis.CreateDataplaneTopicsFromFile(orgIDsFile, authTokenBasic, topicsFile, 10); err != nil {
-		log.Fatalf("Error: %v", err)
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
 	}
-	log.Printf("Topics created and saved to %s\n", topicsFile)
-	time.Sleep(10 * time.Second)
-
-	CreateApisAndRevisions(10)
-	log.Printf("APIs and revisions created and saved to %s\n", apiIDsFile)
-	time.Sleep(10 * time.Second)
 
-	log.Printf("Starting random deployments...\n")
-	apiData, err := utils.LoadAPIData(apiIDsFile)
-	if err != nil {
-		fmt.Printf("Error loading API data: %v\n", err)
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		run := cmd.setup(fs)
+		cfg, err := config.Load(fs, os.Args[2:])
+		if err == nil && cmd.admin {
+			err = cfg.ValidateAdmin()
+		}
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+
+		// Cancel in-flight APIM calls and stop starting new work on Ctrl-C or SIGTERM.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err = run(ctx, cfg)
+		stop()
+		if err != nil {
+			log.Fatalf("%s failed: %v", name, err)
+		}
 		return
 	}
 
-	// Create a buffered channel for messages.
-	messageChan := make(chan asb_client.Message, 20)
-
-	// Create a wait group to synchronize all goroutines.
-	var wg sync.WaitGroup
-
-	// Context with cancellation for graceful shutdown.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	messaging.CreateTopicListeners(ctx, topicsFile, messageChan, &wg)
-
-	outputFileFaulty, err := os.Create("time_differences_faulty.txt")
-	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return
+	if name != "-h" && name != "-help" && name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
 	}
-
-	outputFile, err := os.Create("time_differences.txt")
-	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return
-	}
-
-	// Start a goroutine to listen on the common channel.
-	go messaging.ListenToChannel(messageChan, outputFileFaulty, outputFile)
-
-	go worker.StartRandomDeployments(apiData, authToken, &messaging.SentTimes, 70)
-
-	// Wait for all goroutines to finish.
-	wg.Wait()
+	printUsage()
+	os.Exit(2)
 }
 
-func CreateApisAndRevisions(maxParallel int) {
-	// Load organization IDs from file.
-	orgDataPlanePairs, err := utils.ReadOrgAndDataPlaneIDs(orgIDsFile)
-	if err != nil {
-		fmt.Println("Error reading organization IDs:", err)
-		return
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", filepath.Base(os.Args[0]))
+}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-
-	// Create a semaphore to control the number of parallel goroutines.
-	sem := make(chan struct{}, maxParallel)
-
-	var apiRevisions []string
-
-	for i, orgDataplaneIDPair := range orgDataPlanePairs {
-		sem <- struct{}{}
-		wg.Add(1)
-		go func(i int, orgDataplaneIDPair [2]string) {
-			defer wg.Done()
-
-			name := fmt.Sprintf("location%s", orgDataplaneIDPair[0][len(orgDataplaneIDPair[0])-6:])
-			apiID, err := apis.CreateAPI(name, orgDataplaneIDPair[0], authToken)
-			if err != nil {
-				fmt.Printf("Failed to create API for %s: %v\n", name, err)
-				return
+// allCommand runs every phase in sequence, as the tool did before the phases were split out.
+func allCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	delay := fs.Duration("phase-delay", 10*time.Second, "time to wait between phases so APIM can settle")
+	provision := provisionCommand(fs)
+	registerTopics := registerTopicsCommand(fs)
+	createAPIs := createAPIsCommand(fs)
+	run := runCommand(fs)
+
+	return func(ctx context.Context, cfg *config.Config) error {
+		for _, phase := range []func(context.Context, *config.Config) error{provision, registerTopics, createAPIs} {
+			if err := phase(ctx, cfg); err != nil {
+				return err
 			}
-
-			revisionID, err := apis.CreateRevision(apiID, orgDataplaneIDPair[0], authToken)
-			if err != nil {
-				fmt.Printf("Failed to create revision for API %s: %v\n", apiID, err)
-				return
+			select {
+			case <-time.After(*delay):
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-
-			// Collect API ID and revision ID together.
-			entry := fmt.Sprintf("%s,%s,%s,%s", orgDataplaneIDPair[0], orgDataplaneIDPair[1], apiID, revisionID)
-
-			mu.Lock()
-			apiRevisions = append(apiRevisions, entry)
-			mu.Unlock()
-
-			<-sem
-		}(i, orgDataplaneIDPair)
-	}
-
-	wg.Wait()
-
-	// Save API IDs to file for future use if needed.
-	if err := utils.SaveLinesToFile(apiIDsFile, apiRevisions); err != nil {
-		fmt.Println("Error saving API IDs:", err)
+		}
+		return run(ctx, cfg)
 	}
-	fmt.Println("Finished creating APIs and their revisions.")
 }
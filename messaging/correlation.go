@@ -0,0 +1,521 @@
+package messaging
+
+import (
+	"apim-multi-tenant-asb-load-test/metrics"
+	"apim-multi-tenant-asb-load-test/report"
+	"apim-multi-tenant-asb-load-test/results"
+	"apim-multi-tenant-asb-load-test/state"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Outcome is the state of a Record, or what Match made of an event.
+type Outcome int
+
+const (
+	// Pending records are waiting for their event.
+	Pending Outcome = iota
+	// Matched records received exactly one event.
+	Matched
+	// Lost records received no event before they expired or the run ended.
+	Lost
+	// Duplicate events arrived again for a record that was matched already. The record stays matched
+	// and counts them in Duplicates.
+	Duplicate
+	// Failed records belong to operations APIM rejected, which produce no event.
+	Failed
+	// Unmatched events belong to an API the run operated on but match no pending or recently matched
+	// record, e.g. because it expired already.
+	Unmatched
+	// Unknown events belong to an API the run never operated on.
+	Unknown
+	// Leaked events arrived on a topic of another tenant than the one that owns their API.
+	Leaked
+	// Redelivered events arrived in a message whose ID was received on the subscription before.
+	Redelivered
+)
+
+func (o Outcome) String() string {
+	return [...]string{"pending", "matched", "lost", "duplicate", "failed", "unmatched", "unknown", "leaked", "redelivered"}[o]
+}
+
+// Record is an operation sent to APIM and what became of it.
+type Record struct {
+	ID          int64
+	EventType   string
+	APIID       string
+	RevisionID  string
+	OrgID       string
+	DataPlaneID string
+	Segment     string
+	SentAt      time.Time
+	// CompletedAt is when APIM answered the request. HTTPStatus is the status of a failed request,
+	// zero for successes and requests that got no response.
+	CompletedAt time.Time
+	HTTPStatus  int
+	Err         error
+	Outcome     Outcome
+	// EmittedAt is the timestamp APIM put in the first event of the record, EnqueuedAt when Service
+	// Bus accepted it, ReceivedAt when it arrived, Topic the topic it arrived on and MessageID and
+	// SequenceNumber the message it arrived in.
+	EmittedAt      time.Time
+	EnqueuedAt     time.Time
+	ReceivedAt     time.Time
+	Topic          string
+	MessageID      string
+	SequenceNumber int64
+	Duplicates     int
+
+	// written is set once the result of the record has been written.
+	written bool
+}
+
+// Event is a gateway event received from a topic, with the Service Bus metadata of the message it
+// arrived in.
+type Event struct {
+	Type         string
+	APIID        string
+	RevisionID   string
+	Topic        string
+	Subscription string
+	// At is the timestamp APIM put in the event and EnqueuedAt when Service Bus accepted it. Either is
+	// zero when unknown.
+	At             time.Time
+	EnqueuedAt     time.Time
+	ReceivedAt     time.Time
+	MessageID      string
+	SequenceNumber int64
+	DeliveryCount  uint32
+	ContentType    string
+	Properties     map[string]any
+}
+
+// Latency returns how long the event took to arrive after the operation was sent.
+func (r *Record) Latency() time.Duration {
+	return r.ReceivedAt.Sub(r.SentAt)
+}
+
+// correlationKey identifies the records an event can match.
+type correlationKey struct {
+	eventType string
+	apiID     string
+}
+
+// messageKey identifies a message received on a subscription.
+type messageKey struct {
+	subscription string
+	messageID    string
+}
+
+// Correlator matches gateway events to the records of the operations that caused them. Events of an
+// API match its pending records first in, first out, only those of the event's revision when it
+// names one. Matched records are kept for expireAfter to recognize duplicate events; pending records
+// still unmatched after expireAfter are lost. Every outcome is also recorded in a report.Collector, and every record
+// and event is written to a results.Sink. Events that arrive on a topic of another tenant than the
+// one that owns their API are leaks and match no record. So are events in messages whose ID was
+// received on the subscription within expireAfter, which Service Bus redelivered.
+type Correlator struct {
+	expireAfter time.Duration
+	collector   *report.Collector
+	sink        results.Sink
+	runID       string
+	log         *log.Logger
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[correlationKey][]*Record
+	matched map[correlationKey][]*Record
+	// messages holds when each recently received message arrived.
+	messages map[messageKey]time.Time
+	// apis holds every API the run operated on.
+	apis map[string]bool
+	// tenants are the tenants of the run by org ID, and apiOwners and topicOwners the org IDs of the
+	// tenants their APIs and topics belong to.
+	tenants     map[string]*state.Tenant
+	apiOwners   map[string]string
+	topicOwners map[string]string
+	leaks       []Leak
+}
+
+// NewCorrelator returns an empty correlator for the tenants of a run whose records expire after
+// expireAfter, whose outcomes are recorded in collector and whose results are written to sink,
+// tagged with runID. The APIs and topics of the tenants decide which events leak, which are logged to
+// logger.
+func NewCorrelator(expireAfter time.Duration, tenants []*state.Tenant, collector *report.Collector, sink results.Sink, runID string, logger *log.Logger) *Correlator {
+	c := &Correlator{
+		expireAfter: expireAfter,
+		collector:   collector,
+		sink:        sink,
+		runID:       runID,
+		log:         logger,
+		pending:     map[correlationKey][]*Record{},
+		matched:     map[correlationKey][]*Record{},
+		messages:    map[messageKey]time.Time{},
+		apis:        map[string]bool{},
+		tenants:     map[string]*state.Tenant{},
+		apiOwners:   map[string]string{},
+		topicOwners: map[string]string{},
+	}
+	for _, tenant := range tenants {
+		c.tenants[tenant.OrgID] = tenant
+		for _, api := range tenant.APIs {
+			c.apiOwners[api.ID] = tenant.OrgID
+		}
+		for _, topic := range tenant.Topics {
+			c.topicOwners[topic.Name] = tenant.OrgID
+		}
+	}
+	return c
+}
+
+// Track adds a pending record for an operation that is about to be sent. It must be called before
+// the request, because the event can arrive before APIM answers.
+func (c *Correlator) Track(r *Record) *Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	r.ID = c.nextID
+	r.Outcome = Pending
+	key := correlationKey{r.EventType, r.APIID}
+	c.pending[key] = append(c.pending[key], r)
+	c.apis[r.APIID] = true
+	c.apiOwners[r.APIID] = r.OrgID
+	return r
+}
+
+// Own marks an API the run created for the tenant orgID as one the run operates on before any of its
+// operations is tracked, so its events aren't counted as unknown and are checked for leaks.
+func (c *Correlator) Own(apiID, orgID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apis[apiID] = true
+	c.apiOwners[apiID] = orgID
+}
+
+// Complete records APIM's answer to the operation of r. A failed operation produces no event, so
+// its record stops waiting for one.
+func (c *Correlator) Complete(r *Record, status int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.CompletedAt = time.Now()
+	r.HTTPStatus = status
+	c.stage(report.StageHTTP, r.CompletedAt.Sub(r.SentAt))
+	r.Err = err
+	// The event, and even duplicates of it, may have arrived before the response, also when the
+	// response is an error such as a timeout after APIM acted.
+	if r.Outcome == Matched {
+		c.write(r)
+		return
+	}
+	if err == nil || r.Outcome != Pending {
+		return
+	}
+	r.Outcome = Failed
+	c.collector.Failed(r.OrgID)
+	c.write(r)
+	key := correlationKey{r.EventType, r.APIID}
+	c.pending[key] = remove(c.pending[key], r)
+	if len(c.pending[key]) == 0 {
+		delete(c.pending, key)
+	}
+}
+
+// Match correlates an event with a record. It returns the oldest pending record of the API and event
+// type, of the event's revision if it names one, and marks it matched. An event with no pending
+// record but a recently matched one is a duplicate of it. Otherwise Match returns nil and whether
+// the event's API is one the run operated on. A redelivered or leaked event matches
+// nothing; leaks are logged and kept for Leaks.
+func (c *Correlator) Match(e Event) (*Record, Outcome) {
+	r, outcome := c.match(e)
+	metrics.Outcomes.WithLabelValues(outcome.String()).Inc()
+	if outcome == Matched {
+		metrics.EventLatency.WithLabelValues(e.Type).Observe(r.Latency().Seconds())
+	}
+	return r, outcome
+}
+
+func (c *Correlator) match(e Event) (*Record, Outcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := correlationKey{e.Type, e.APIID}
+
+	if e.MessageID != "" {
+		message := messageKey{e.Subscription, e.MessageID}
+		if _, ok := c.messages[message]; ok {
+			c.writeEvent(e, nil, Redelivered)
+			return nil, Redelivered
+		}
+		c.messages[message] = e.ReceivedAt
+	}
+
+	if leak, ok := c.leak(e); ok {
+		c.log.Printf("LEAK: %s\n", leak)
+		c.leaks = append(c.leaks, leak)
+		c.writeEvent(e, nil, Leaked)
+		return nil, Leaked
+	}
+
+	if r := first(c.pending[key], e.RevisionID); r != nil {
+		c.pending[key] = remove(c.pending[key], r)
+		if len(c.pending[key]) == 0 {
+			delete(c.pending, key)
+		}
+		r.Outcome = Matched
+		r.EmittedAt = e.At
+		r.EnqueuedAt = e.EnqueuedAt
+		r.ReceivedAt = e.ReceivedAt
+		r.Topic = e.Topic
+		r.MessageID = e.MessageID
+		r.SequenceNumber = e.SequenceNumber
+		c.matched[key] = append(c.matched[key], r)
+		c.collector.Matched(r.OrgID, e.Topic, r.Latency())
+		c.stages(r)
+		c.writeEvent(e, r, Matched)
+		if !r.CompletedAt.IsZero() {
+			c.write(r)
+		}
+		return r, Matched
+	}
+
+	if r := last(c.matched[key], e.RevisionID); r != nil {
+		r.Duplicates++
+		c.collector.Duplicate(r.OrgID, e.Topic)
+		c.writeEvent(e, r, Duplicate)
+		return r, Duplicate
+	}
+	outcome := Unknown
+	if c.apis[e.APIID] {
+		outcome = Unmatched
+	}
+	c.collector.Unexpected(e.Topic, outcome == Unknown)
+	c.writeEvent(e, nil, outcome)
+	return nil, outcome
+}
+
+// stages records the latency of the stages of a matched record whose ends are known. The stages are
+// measured on the clocks of the load test, APIM and Service Bus, so they only add up to the
+// end-to-end latency as far as those clocks agree.
+func (c *Correlator) stages(r *Record) {
+	if !r.EmittedAt.IsZero() {
+		c.stage(report.StageEmit, r.EmittedAt.Sub(r.SentAt))
+	}
+	if !r.EnqueuedAt.IsZero() {
+		if !r.EmittedAt.IsZero() {
+			c.stage(report.StageEnqueue, r.EnqueuedAt.Sub(r.EmittedAt))
+		}
+		c.stage(report.StageReceive, r.ReceivedAt.Sub(r.EnqueuedAt))
+	}
+}
+
+// stage records the latency of a stage in the collector and the metrics.
+func (c *Correlator) stage(stage report.Stage, latency time.Duration) {
+	c.collector.Stage(stage, latency)
+	metrics.StageLatency.WithLabelValues(stage.String()).Observe(max(latency, 0).Seconds())
+}
+
+// leak returns the leak of an event whose API and topic belong to different tenants. Events of APIs or
+// topics of no tenant of the run can't be checked.
+func (c *Correlator) leak(e Event) (Leak, bool) {
+	owner, ok := c.apiOwners[e.APIID]
+	if !ok {
+		return Leak{}, false
+	}
+	topicOwner, ok := c.topicOwners[e.Topic]
+	if !ok || topicOwner == owner {
+		return Leak{}, false
+	}
+	leak := Leak{Event: e, OrgID: owner, TopicOrgID: topicOwner}
+	if tenant, ok := c.tenants[owner]; ok {
+		leak.DataPlaneID = tenant.DataPlaneID
+	}
+	if tenant, ok := c.tenants[topicOwner]; ok {
+		leak.TopicDataPlaneID = tenant.DataPlaneID
+	}
+	return leak, true
+}
+
+// Leaks returns the events that leaked across tenants so far.
+func (c *Correlator) Leaks() []Leak {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Leak(nil), c.leaks...)
+}
+
+// Expire marks the pending records sent before now minus expireAfter as lost and returns them. It
+// also forgets the matched records and the messages received that long ago.
+func (c *Correlator) Expire(now time.Time) []*Record {
+	return c.expire(now.Add(-c.expireAfter))
+}
+
+// Sweep expires records every interval until ctx is done, passing the lost ones to onLost.
+func (c *Correlator) Sweep(ctx context.Context, interval time.Duration, onLost func([]*Record)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if lost := c.Expire(now); len(lost) > 0 {
+				onLost(lost)
+			}
+		}
+	}
+}
+
+// Drain marks every pending record as lost and returns them, for the end of a run.
+func (c *Correlator) Drain() []*Record {
+	return c.expire(time.Now().Add(time.Hour))
+}
+
+func (c *Correlator) expire(cutoff time.Time) []*Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lost []*Record
+	for key, records := range c.pending {
+		kept := records[:0]
+		for _, r := range records {
+			if r.SentAt.Before(cutoff) {
+				r.Outcome = Lost
+				c.collector.Lost(r.OrgID)
+				metrics.Outcomes.WithLabelValues(Lost.String()).Inc()
+				c.write(r)
+				lost = append(lost, r)
+			} else {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.pending, key)
+		} else {
+			c.pending[key] = kept
+		}
+	}
+
+	for key, records := range c.matched {
+		kept := records[:0]
+		for _, r := range records {
+			if !r.ReceivedAt.Before(cutoff) {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.matched, key)
+		} else {
+			c.matched[key] = kept
+		}
+	}
+
+	for message, receivedAt := range c.messages {
+		if receivedAt.Before(cutoff) {
+			delete(c.messages, message)
+		}
+	}
+	return lost
+}
+
+// write writes the result of a record once its outcome is final.
+func (c *Correlator) write(r *Record) {
+	if r.written {
+		return
+	}
+	r.written = true
+	result := results.Result{
+		Kind:        results.KindOperation,
+		RunID:       c.runID,
+		OrgID:       r.OrgID,
+		DataPlaneID: r.DataPlaneID,
+		APIID:       r.APIID,
+		RevisionID:  r.RevisionID,
+		EventType:   r.EventType,
+		Segment:     r.Segment,
+		Topic:       r.Topic,
+		MessageID:   r.MessageID,
+		Outcome:     r.Outcome.String(),
+		SentAt:      r.SentAt,
+		HTTPStatus:  r.HTTPStatus,
+		EventAt:     r.EmittedAt,
+		EnqueuedAt:  r.EnqueuedAt,
+		ReceivedAt:  r.ReceivedAt,
+	}
+	if !r.CompletedAt.IsZero() {
+		result.HTTPDuration = r.CompletedAt.Sub(r.SentAt)
+	}
+	if r.Err != nil {
+		result.Error = r.Err.Error()
+	}
+	if r.Outcome == Matched {
+		result.Latency = r.Latency()
+	}
+	if err := c.sink.Write(result); err != nil {
+		c.log.Printf("failed to write result: %s\n", err.Error())
+	}
+}
+
+// writeEvent writes the result of an event and the record it matched, if any.
+func (c *Correlator) writeEvent(e Event, r *Record, outcome Outcome) {
+	result := results.Result{
+		Kind:       results.KindEvent,
+		RunID:      c.runID,
+		APIID:      e.APIID,
+		RevisionID: e.RevisionID,
+		EventType:  e.Type,
+		Topic:      e.Topic,
+		Outcome:    outcome.String(),
+		EventAt:    e.At,
+		EnqueuedAt: e.EnqueuedAt,
+		ReceivedAt: e.ReceivedAt,
+
+		Subscription:   e.Subscription,
+		MessageID:      e.MessageID,
+		SequenceNumber: e.SequenceNumber,
+		DeliveryCount:  e.DeliveryCount,
+		ContentType:    e.ContentType,
+		Properties:     e.Properties,
+	}
+	if r != nil {
+		result.OrgID = r.OrgID
+		result.DataPlaneID = r.DataPlaneID
+		result.RevisionID = r.RevisionID
+		result.Segment = r.Segment
+		result.SentAt = r.SentAt
+		result.Latency = e.ReceivedAt.Sub(r.SentAt)
+	}
+	if err := c.sink.Write(result); err != nil {
+		c.log.Printf("failed to write result: %s\n", err.Error())
+	}
+}
+
+// first returns the oldest record of the revision, or the oldest record if revisionID is empty.
+// Records that name no revision belong to any.
+func first(records []*Record, revisionID string) *Record {
+	for _, r := range records {
+		if revisionID == "" || r.RevisionID == "" || r.RevisionID == revisionID {
+			return r
+		}
+	}
+	return nil
+}
+
+// last returns the most recently matched record of the revision, or the most recent one if
+// revisionID is empty. Records that name no revision belong to any.
+func last(records []*Record, revisionID string) *Record {
+	for i := len(records) - 1; i >= 0; i-- {
+		if revisionID == "" || records[i].RevisionID == "" || records[i].RevisionID == revisionID {
+			return records[i]
+		}
+	}
+	return nil
+}
+
+func remove(records []*Record, r *Record) []*Record {
+	for i, candidate := range records {
+		if candidate == r {
+			return append(records[:i], records[i+1:]...)
+		}
+	}
+	return records
+}
@@ -0,0 +1,326 @@
+package messaging
+
+import (
+	"apim-multi-tenant-asb-load-test/report"
+	"apim-multi-tenant-asb-load-test/results"
+	"apim-multi-tenant-asb-load-test/state"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink keeps the results written to it.
+type memorySink struct {
+	mu      sync.Mutex
+	results []results.Result
+}
+
+func (s *memorySink) Write(r results.Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, r)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+// operations returns the outcome written for each operation, by the segment naming its record.
+func (s *memorySink) operations() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := map[string]string{}
+	for _, r := range s.results {
+		if r.Kind == results.KindOperation {
+			written[r.Segment] = r.Outcome
+		}
+	}
+	return written
+}
+
+// step is one thing that happens to a correlator: an operation is tracked or completed, an event
+// arrives or records expire.
+type step struct {
+	// track sends an operation of the revision, named track, sentAt after the start of the test.
+	track    string
+	revision string
+	sentAt   time.Duration
+	// complete answers the operation named complete, failing it with err if set.
+	complete string
+	err      error
+	// event arrives and must have outcome want, matching the record named record if any.
+	event  *Event
+	want   Outcome
+	record string
+	// expire expires the records sent expireAfter before expireAt.
+	expire   bool
+	expireAt time.Duration
+	lost     []string
+}
+
+const expireAfter = time.Minute
+
+// event returns a deploy event of the API of org-a on its topic.
+func event(revisionID string, receivedAt time.Duration, messageID string) *Event {
+	return &Event{
+		Type:         "DEPLOY_API_IN_GATEWAY",
+		APIID:        "api-a",
+		RevisionID:   revisionID,
+		Topic:        "topic-a",
+		Subscription: "sub-a",
+		ReceivedAt:   start.Add(receivedAt),
+		MessageID:    messageID,
+	}
+}
+
+var start = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestCorrelator(t *testing.T) {
+	timeout := errors.New("context deadline exceeded")
+
+	tests := []struct {
+		name  string
+		steps []step
+		// outcomes are the outcomes of the records at the end, written those written to the sink and
+		// duplicates the duplicate events counted on them.
+		outcomes   map[string]Outcome
+		written    map[string]string
+		duplicates map[string]int
+	}{
+		{
+			name: "first in first out per revision",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{track: "r2", revision: "rev-2", sentAt: time.Second},
+				{track: "r3", revision: "rev-1", sentAt: 2 * time.Second},
+				{complete: "r1"}, {complete: "r2"}, {complete: "r3"},
+				{event: event("rev-1", 3*time.Second, "m1"), want: Matched, record: "r1"},
+				{event: event("rev-2", 4*time.Second, "m2"), want: Matched, record: "r2"},
+				{event: event("rev-1", 5*time.Second, "m3"), want: Matched, record: "r3"},
+			},
+			outcomes: map[string]Outcome{"r1": Matched, "r2": Matched, "r3": Matched},
+			written:  map[string]string{"r1": "matched", "r2": "matched", "r3": "matched"},
+		},
+		{
+			name: "event of a revision without pending records",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{complete: "r1"},
+				{event: event("rev-2", time.Second, "m1"), want: Unmatched},
+				{event: event("rev-1", 2*time.Second, "m2"), want: Matched, record: "r1"},
+			},
+			outcomes: map[string]Outcome{"r1": Matched},
+			written:  map[string]string{"r1": "matched"},
+		},
+		{
+			name: "event without a revision",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{track: "r2", revision: "rev-2", sentAt: time.Second},
+				{event: event("", 2*time.Second, "m1"), want: Matched, record: "r1"},
+			},
+			outcomes: map[string]Outcome{"r1": Matched, "r2": Pending},
+			written:  map[string]string{},
+		},
+		{
+			name: "event before the response",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{event: event("rev-1", time.Second, "m1"), want: Matched, record: "r1"},
+				{complete: "r1"},
+			},
+			outcomes: map[string]Outcome{"r1": Matched},
+			written:  map[string]string{"r1": "matched"},
+		},
+		{
+			name: "event before an error response",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{event: event("rev-1", time.Second, "m1"), want: Matched, record: "r1"},
+				{complete: "r1", err: timeout},
+			},
+			outcomes: map[string]Outcome{"r1": Matched},
+			written:  map[string]string{"r1": "matched"},
+		},
+		{
+			name: "failed operation",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{complete: "r1", err: timeout},
+				{event: event("rev-1", time.Second, "m1"), want: Unmatched},
+			},
+			outcomes: map[string]Outcome{"r1": Failed},
+			written:  map[string]string{"r1": "failed"},
+		},
+		{
+			name: "duplicate",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{complete: "r1"},
+				{event: event("rev-1", time.Second, "m1"), want: Matched, record: "r1"},
+				{event: event("rev-1", 2*time.Second, "m2"), want: Duplicate, record: "r1"},
+				{event: event("rev-1", 3*time.Second, "m3"), want: Duplicate, record: "r1"},
+			},
+			outcomes:   map[string]Outcome{"r1": Matched},
+			written:    map[string]string{"r1": "matched"},
+			duplicates: map[string]int{"r1": 2},
+		},
+		{
+			name: "duplicate before the response",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{event: event("rev-1", time.Second, "m1"), want: Matched, record: "r1"},
+				{event: event("rev-1", 2*time.Second, "m2"), want: Duplicate, record: "r1"},
+				{complete: "r1"},
+			},
+			outcomes:   map[string]Outcome{"r1": Matched},
+			written:    map[string]string{"r1": "matched"},
+			duplicates: map[string]int{"r1": 1},
+		},
+		{
+			name: "duplicate of another revision",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{event: event("rev-1", time.Second, "m1"), want: Matched, record: "r1"},
+				{event: event("rev-2", 2*time.Second, "m2"), want: Unmatched},
+			},
+			outcomes: map[string]Outcome{"r1": Matched},
+			written:  map[string]string{},
+		},
+		{
+			name: "redelivered message",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{track: "r2", revision: "rev-1", sentAt: time.Second},
+				{event: event("rev-1", 2*time.Second, "m1"), want: Matched, record: "r1"},
+				{event: event("rev-1", 3*time.Second, "m1"), want: Redelivered},
+			},
+			outcomes: map[string]Outcome{"r1": Matched, "r2": Pending},
+			written:  map[string]string{},
+		},
+		{
+			name: "leak",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{event: &Event{Type: "DEPLOY_API_IN_GATEWAY", APIID: "api-a", RevisionID: "rev-1", Topic: "topic-b", ReceivedAt: start}, want: Leaked},
+			},
+			outcomes: map[string]Outcome{"r1": Pending},
+			written:  map[string]string{},
+		},
+		{
+			name: "unknown API",
+			steps: []step{
+				{event: &Event{Type: "DEPLOY_API_IN_GATEWAY", APIID: "api-x", Topic: "topic-a", ReceivedAt: start}, want: Unknown},
+			},
+		},
+		{
+			name: "expiry",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{track: "r2", revision: "rev-1", sentAt: 30 * time.Second},
+				{complete: "r1"}, {complete: "r2"},
+				{expire: true, expireAt: 45 * time.Second},
+				{expire: true, expireAt: 75 * time.Second, lost: []string{"r1"}},
+				{event: event("rev-1", 80*time.Second, "m1"), want: Matched, record: "r2"},
+			},
+			outcomes: map[string]Outcome{"r1": Lost, "r2": Matched},
+			written:  map[string]string{"r1": "lost", "r2": "matched"},
+		},
+		{
+			name: "matched records expire",
+			steps: []step{
+				{track: "r1", revision: "rev-1"},
+				{complete: "r1"},
+				{event: event("rev-1", time.Second, "m1"), want: Matched, record: "r1"},
+				{expire: true, expireAt: 2 * time.Minute},
+				{event: event("rev-1", 2*time.Minute, "m1"), want: Unmatched},
+			},
+			outcomes: map[string]Outcome{"r1": Matched},
+			written:  map[string]string{"r1": "matched"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenants := []*state.Tenant{
+				{OrgID: "org-a", APIs: []state.API{{ID: "api-a"}}, Topics: []state.Topic{{Name: "topic-a"}}},
+				{OrgID: "org-b", APIs: []state.API{{ID: "api-b"}}, Topics: []state.Topic{{Name: "topic-b"}}},
+			}
+			sink := &memorySink{}
+			c := NewCorrelator(expireAfter, tenants, report.NewCollector(tenants), sink, "run", log.Default())
+			records := map[string]*Record{}
+			names := map[*Record]string{}
+
+			for i, s := range tt.steps {
+				switch {
+				case s.track != "":
+					r := c.Track(&Record{
+						EventType:  "DEPLOY_API_IN_GATEWAY",
+						APIID:      "api-a",
+						RevisionID: s.revision,
+						OrgID:      "org-a",
+						Segment:    s.track,
+						SentAt:     start.Add(s.sentAt),
+					})
+					records[s.track] = r
+					names[r] = s.track
+				case s.complete != "":
+					c.Complete(records[s.complete], 0, s.err)
+				case s.event != nil:
+					r, outcome := c.Match(*s.event)
+					if outcome != s.want || names[r] != s.record {
+						t.Errorf("step %d: Match = %q, %s, want %q, %s", i, names[r], outcome, s.record, s.want)
+					}
+				case s.expire:
+					var lost []string
+					for _, r := range c.Expire(start.Add(s.expireAt)) {
+						lost = append(lost, names[r])
+					}
+					if len(lost) != len(s.lost) || (len(lost) > 0 && lost[0] != s.lost[0]) {
+						t.Errorf("step %d: Expire = %v, want %v", i, lost, s.lost)
+					}
+				}
+			}
+
+			for name, want := range tt.outcomes {
+				if got := records[name].Outcome; got != want {
+					t.Errorf("outcome of %s = %s, want %s", name, got, want)
+				}
+			}
+			for name, want := range tt.duplicates {
+				if got := records[name].Duplicates; got != want {
+					t.Errorf("duplicates of %s = %d, want %d", name, got, want)
+				}
+			}
+			written := sink.operations()
+			if len(written) != len(tt.written) {
+				t.Errorf("written operations = %v, want %v", written, tt.written)
+			}
+			for name, want := range tt.written {
+				if got := written[name]; got != want {
+					t.Errorf("written outcome of %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCorrelatorLeaks(t *testing.T) {
+	tenants := []*state.Tenant{
+		{OrgID: "org-a", DataPlaneID: "dp-a", APIs: []state.API{{ID: "api-a"}}, Topics: []state.Topic{{Name: "topic-a"}}},
+		{OrgID: "org-b", DataPlaneID: "dp-b", APIs: []state.API{{ID: "api-b"}}, Topics: []state.Topic{{Name: "topic-b"}}},
+	}
+	c := NewCorrelator(expireAfter, tenants, report.NewCollector(tenants), &memorySink{}, "run", log.Default())
+	c.Match(Event{Type: "DEPLOY_API_IN_GATEWAY", APIID: "api-b", Topic: "topic-a", ReceivedAt: start})
+	c.Match(Event{Type: "DEPLOY_API_IN_GATEWAY", APIID: "api-b", Topic: "topic-b", ReceivedAt: start})
+
+	leaks := c.Leaks()
+	if len(leaks) != 1 {
+		t.Fatalf("Leaks = %v, want one", leaks)
+	}
+	got := leaks[0]
+	if got.OrgID != "org-b" || got.DataPlaneID != "dp-b" || got.TopicOrgID != "org-a" || got.TopicDataPlaneID != "dp-a" {
+		t.Errorf("leak = %s, want api-b of org-b on the topic of org-a", got)
+	}
+}
@@ -0,0 +1,42 @@
+package messaging
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Leak is an event that arrived on a topic of another tenant than the one that owns its API. Every
+// leak breaks tenant isolation.
+type Leak struct {
+	Event Event
+	// TopicOrgID and TopicDataPlaneID identify the tenant the topic was registered for, OrgID and
+	// DataPlaneID the tenant that owns the API.
+	TopicOrgID       string
+	TopicDataPlaneID string
+	OrgID            string
+	DataPlaneID      string
+}
+
+func (l Leak) String() string {
+	return fmt.Sprintf("event %s of API %s revision %s (org %s, dataplane %s) arrived on topic %s of org %s, dataplane %s; emitted %s, received %s",
+		l.Event.Type, l.Event.APIID, l.Event.RevisionID, l.OrgID, l.DataPlaneID, l.Event.Topic, l.TopicOrgID, l.TopicDataPlaneID,
+		formatTime(l.Event.At), formatTime(l.Event.ReceivedAt))
+}
+
+// WriteLeaks writes the events that leaked across tenants to outputFile.
+func WriteLeaks(outputFile *os.File, leaks []Leak) error {
+	for _, leak := range leaks {
+		if _, err := fmt.Fprintln(outputFile, leak); err != nil {
+			return fmt.Errorf("failed to write to file: %w", err)
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -2,10 +2,12 @@ package messaging
 
 import (
 	"apim-multi-tenant-asb-load-test/asb_client"
-	"apim-multi-tenant-asb-load-test/utils"
+	"apim-multi-tenant-asb-load-test/metrics"
+	"apim-multi-tenant-asb-load-test/state"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -26,61 +28,210 @@ type PayloadData struct {
 }
 
 type APIEvent struct {
-	ApiID int    `json:"apiId"`
-	UUID  string `json:"uuid"`
-	Name  string `json:"name"`
+	ApiID      int    `json:"apiId"`
+	UUID       string `json:"uuid"`
+	Name       string `json:"name"`
+	RevisionID string `json:"revisionId"`
 }
 
-var SentTimes = sync.Map{}
+// ListenStats counts the messages seen by a Listener.
+type ListenStats struct {
+	Received   int
+	Matched    int
+	Late       int
+	Duplicates int
+	// Unmatched counts the events of APIs the run operated on that matched no record, e.g. because
+	// it had expired already.
+	Unmatched int
+	// Unknown counts the events of APIs the run never operated on.
+	Unknown int
+	// Leaked counts the events that arrived on a topic of another tenant than the API's.
+	Leaked int
+	// Undecodable counts the messages whose gateway event couldn't be decoded. They match nothing.
+	Undecodable int
+	// Redelivered counts the events in messages whose ID was received before, and Redeliveries the
+	// messages Service Bus delivered more than once because they weren't completed in time.
+	Redelivered  int
+	Redeliveries int
+	// ByEventType counts the matched events of each type.
+	ByEventType map[string]int
+}
+
+// Listener matches the messages of the topic listeners to the records of their operations and
+// counts them. Events are matched in a Correlator, which also writes their results; those arriving
+// more than lateThreshold after their operation was sent are counted as late.
+type Listener struct {
+	records       *Correlator
+	lateThreshold time.Duration
+	// quiet stops logging every received message, e.g. while a dashboard shows the counts instead.
+	quiet bool
+	log   *log.Logger
+
+	mu    sync.Mutex
+	stats ListenStats
+}
+
+// NewListener returns a listener that matches events in records and logs to logger. A quiet listener
+// doesn't log the messages it receives.
+func NewListener(records *Correlator, lateThreshold time.Duration, quiet bool, logger *log.Logger) *Listener {
+	return &Listener{
+		records:       records,
+		lateThreshold: lateThreshold,
+		quiet:         quiet,
+		log:           logger,
+		stats:         ListenStats{ByEventType: map[string]int{}},
+	}
+}
+
+// Stats returns the counts so far.
+func (l *Listener) Stats() ListenStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.ByEventType = make(map[string]int, len(l.stats.ByEventType))
+	for eventType, n := range l.stats.ByEventType {
+		stats.ByEventType[eventType] = n
+	}
+	return stats
+}
 
-// ListenToChannel function for the common channel to print received messages.
-func ListenToChannel(messageChan <-chan asb_client.Message, outputFileFaulty, outputFile *os.File) {
+// ListenToChannel function for the common channel to print received messages. It returns the counts
+// once messageChan is closed.
+func (l *Listener) ListenToChannel(messageChan <-chan asb_client.Message) ListenStats {
 	for msg := range messageChan {
-		// unmarshal the message into a struct
-		var eventPayload EventPayload
-		if err := json.Unmarshal([]byte(msg.Content), &eventPayload); err == nil {
-			if eventPayload.Event.PayloadData.EventType == "DEPLOY_API_IN_GATEWAY" {
-				decodedBytes, err := base64.StdEncoding.DecodeString(eventPayload.Event.PayloadData.Event)
-				if err != nil {
-					fmt.Printf("failed to decode base64: %s\n", err.Error())
-				}
-				// Unmarshal the JSON into the APIEvent struct
-				var apiEvent APIEvent
-				if err := json.Unmarshal(decodedBytes, &apiEvent); err != nil {
-					fmt.Printf("failed to unmarshal JSON: %s\n", err.Error())
-				}
-				if t, ok := SentTimes.Load(apiEvent.UUID); ok {
-					timestamp := t.(time.Time)
-					if timestamp.Before(time.Now().Add(-1 * time.Minute)) {
-						_, err := outputFileFaulty.WriteString(fmt.Sprintf("API UUID: %s, diff:%s\n", apiEvent.UUID, time.Now().Sub(timestamp).String()))
-						if err != nil {
-							fmt.Printf("failed to write to file: %s\n", err.Error())
-						}
-					} else {
-						_, err := outputFile.WriteString(fmt.Sprintf("API UUID: %s, diff:%s\n", apiEvent.UUID, time.Now().Sub(timestamp).String()))
-						if err != nil {
-							fmt.Printf("failed to write to file: %s\n", err.Error())
-						}
-					}
-				}
+		l.receive(msg)
+	}
+	return l.Stats()
+}
+
+// receive matches the event in a message and counts the outcome.
+func (l *Listener) receive(msg asb_client.Message) {
+	receivedAt := msg.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	event, err := decode(msg, receivedAt)
+	ok := err == nil
+	undecodable := err != nil && !errors.Is(err, errNoEvent)
+	var record *Record
+	var outcome Outcome
+	switch {
+	case ok:
+		metrics.EventsReceived.WithLabelValues(event.Topic, event.Type).Inc()
+		record, outcome = l.records.Match(event)
+	case undecodable:
+		metrics.EventsUndecodable.WithLabelValues(msg.Topic).Inc()
+		l.log.Printf("Failed to decode message %s from topic '%s': %v\n", msg.MessageID, msg.Topic, err)
+	}
+
+	l.mu.Lock()
+	stats := &l.stats
+	stats.Received++
+	if msg.DeliveryCount > 1 {
+		stats.Redeliveries++
+	}
+	if undecodable {
+		stats.Undecodable++
+	}
+	if ok {
+		switch outcome {
+		case Matched:
+			stats.Matched++
+			stats.ByEventType[event.Type]++
+			if record.Latency() > l.lateThreshold {
+				stats.Late++
 			}
+		case Duplicate:
+			stats.Duplicates++
+		case Unmatched:
+			stats.Unmatched++
+		case Unknown:
+			stats.Unknown++
+		case Leaked:
+			stats.Leaked++
+		case Redelivered:
+			stats.Redelivered++
 		}
-		fmt.Printf("Received message from topic '%s': %s\n", msg.Topic, msg.Content)
+	}
+	l.mu.Unlock()
+
+	if !l.quiet {
+		l.log.Printf("Received message %s (sequence %d, delivery %d) from topic '%s': %s\n",
+			msg.MessageID, msg.SequenceNumber, msg.DeliveryCount, msg.Topic, msg.Content)
 	}
 }
 
-// CreateTopicListeners function to create listeners for each topic.
-func CreateTopicListeners(ctx context.Context, topicsFilePath string, messageChan chan<- asb_client.Message, wg *sync.WaitGroup) {
-	configs, err := utils.ReadAsbTopicAndConnectionStringsFromFile(topicsFilePath)
+// errNoEvent is returned by decode for messages that carry no gateway event.
+var errNoEvent = errors.New("message carries no gateway event")
+
+// decode returns the gateway event in a message. It returns errNoEvent if the message carries none
+// and another error if the message or its event can't be decoded.
+func decode(msg asb_client.Message, receivedAt time.Time) (Event, error) {
+	// unmarshal the message into a struct
+	var eventPayload EventPayload
+	if err := json.Unmarshal([]byte(msg.Content), &eventPayload); err != nil {
+		return Event{}, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	payload := eventPayload.Event.PayloadData
+	if payload.Event == "" {
+		return Event{}, errNoEvent
+	}
+	decodedBytes, err := base64.StdEncoding.DecodeString(payload.Event)
 	if err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+		return Event{}, fmt.Errorf("failed to decode base64: %w", err)
+	}
+	// Unmarshal the JSON into the APIEvent struct
+	var apiEvent APIEvent
+	if err := json.Unmarshal(decodedBytes, &apiEvent); err != nil {
+		return Event{}, fmt.Errorf("failed to unmarshal event: %w", err)
+	}
+	event := Event{
+		Type:           payload.EventType,
+		APIID:          apiEvent.UUID,
+		RevisionID:     apiEvent.RevisionID,
+		Topic:          msg.Topic,
+		Subscription:   msg.Subscription,
+		EnqueuedAt:     msg.EnqueuedAt,
+		ReceivedAt:     receivedAt,
+		MessageID:      msg.MessageID,
+		SequenceNumber: msg.SequenceNumber,
+		DeliveryCount:  msg.DeliveryCount,
+		ContentType:    msg.ContentType,
+		Properties:     msg.ApplicationProperties,
+	}
+	if payload.Timestamp != 0 {
+		event.At = time.UnixMilli(payload.Timestamp)
 	}
+	return event, nil
+}
 
-	for _, config := range configs {
-		topicName := config[0]
-		connStr := config[1]
+// WriteLost writes the records of operations whose event never arrived to outputFile.
+func WriteLost(outputFile *os.File, lost []*Record) error {
+	for _, r := range lost {
+		_, err := outputFile.WriteString(fmt.Sprintf("API UUID: %s, event: %s, revision: %s, org: %s, dataplane: %s, segment: %s, sent: %s\n",
+			r.APIID, r.EventType, r.RevisionID, r.OrgID, r.DataPlaneID, r.Segment, r.SentAt.Format(time.RFC3339Nano)))
+		if err != nil {
+			return fmt.Errorf("failed to write to file: %w", err)
+		}
+	}
+	return nil
+}
 
-		wg.Add(1)
-		go asb_client.CreateASBListener(ctx, connStr, topicName, messageChan, wg)
+// CreateTopicListeners function to create listeners for every topic registered for the tenants, which
+// log to logger. The subscriptions the listeners create are recorded in the run state.
+func CreateTopicListeners(ctx context.Context, store *state.Store, messageChan chan<- asb_client.Message, wg *sync.WaitGroup, logger *log.Logger) {
+	for _, tenant := range store.Tenants() {
+		for i := range tenant.Topics {
+			topic := &tenant.Topics[i]
+			onSubscribe := func(subscriptionName string) {
+				err := store.Update(func(*state.Run) { topic.Subscriptions = append(topic.Subscriptions, subscriptionName) })
+				if err != nil {
+					logger.Printf("Failed to record subscription %s for topic %s: %v", subscriptionName, topic.Name, err)
+				}
+			}
+
+			wg.Add(1)
+			go asb_client.CreateASBListener(ctx, topic.ConnectionString, topic.Name, messageChan, onSubscribe, wg, logger)
+		}
 	}
 }
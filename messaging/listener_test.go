@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"apim-multi-tenant-asb-load-test/asb_client"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	message := func(event string) string {
+		return `{"event":{"payloadData":{"eventType":"DEPLOY_API_IN_GATEWAY","timestamp":1735732800000,"event":"` + event + `"}}}`
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    Event
+		wantErr error
+		// undecodable is set for errors other than errNoEvent.
+		undecodable bool
+	}{
+		{
+			name:    "event",
+			content: message(encode(`{"uuid":"api-a","revisionId":"rev-1"}`)),
+			want:    Event{Type: "DEPLOY_API_IN_GATEWAY", APIID: "api-a", RevisionID: "rev-1", Topic: "topic-a", At: time.UnixMilli(1735732800000)},
+		},
+		{name: "no event", content: `{"event":{"payloadData":{}}}`, wantErr: errNoEvent},
+		{name: "not JSON", content: `not json`, undecodable: true},
+		{name: "invalid base64", content: message("%%%"), undecodable: true},
+		{name: "invalid event", content: message(encode(`{"uuid":`)), undecodable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decode(asb_client.Message{Topic: "topic-a", Content: tt.content}, time.Time{})
+			switch {
+			case tt.undecodable:
+				if err == nil || errors.Is(err, errNoEvent) {
+					t.Errorf("decode error = %v, want an undecodable message", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("decode error = %v, want %v", err, tt.wantErr)
+			case err == nil && (got.Type != tt.want.Type || got.APIID != tt.want.APIID || got.RevisionID != tt.want.RevisionID ||
+				got.Topic != tt.want.Topic || !got.At.Equal(tt.want.At)):
+				t.Errorf("decode = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
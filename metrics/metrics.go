@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds the metrics of the load test together with those of the Go runtime and the process.
+var Registry = prometheus.NewRegistry()
+
+// latencyBuckets cover 10ms to about 5.5 minutes, beyond the default time an operation waits for
+// its event.
+var latencyBuckets = prometheus.ExponentialBuckets(0.01, 2, 16)
+
+var factory = promauto.With(Registry)
+
+// Metrics of the generator.
+var (
+	OperationsIssued = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_operations_issued_total",
+		Help: "Operations sent to APIM.",
+	}, []string{"operation"})
+	OperationsDropped = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_operations_dropped_total",
+		Help: "Operations not sent because the concurrency cap was reached.",
+	}, []string{"operation"})
+	OperationsCompleted = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_operations_completed_total",
+		Help: "Operations APIM answered, by outcome and HTTP status. The status is 2xx for successes and empty when no response arrived.",
+	}, []string{"operation", "outcome", "status"})
+	StepsFailed = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_operation_steps_failed_total",
+		Help: "Failed steps around operations, such as creating the revision of an update, by HTTP status. The status is empty when no response arrived.",
+	}, []string{"operation", "step", "status"})
+	OperationDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loadtest_operation_duration_seconds",
+		Help:    "Time APIM took to answer an operation.",
+		Buckets: latencyBuckets,
+	}, []string{"operation"})
+	OperationsInFlight = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "loadtest_operations_in_flight",
+		Help: "Operations sent to APIM and not answered yet.",
+	})
+)
+
+// Metrics of the correlation of events with operations.
+var (
+	EventsReceived = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_events_received_total",
+		Help: "Gateway events received, by topic and event type.",
+	}, []string{"topic", "event_type"})
+	Outcomes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_correlation_outcomes_total",
+		Help: "Events by what they were correlated with, and operations lost without an event.",
+	}, []string{"outcome"})
+	EventsUndecodable = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_events_undecodable_total",
+		Help: "Messages whose gateway event couldn't be decoded, by topic.",
+	}, []string{"topic"})
+	EventLatency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loadtest_event_latency_seconds",
+		Help:    "Time from sending an operation to receiving its event.",
+		Buckets: latencyBuckets,
+	}, []string{"event_type"})
+	StageLatency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loadtest_stage_latency_seconds",
+		Help:    "Time spent in each stage from sending an operation to receiving its event.",
+		Buckets: latencyBuckets,
+	}, []string{"stage"})
+)
+
+// Metrics of the Service Bus listeners.
+var (
+	Listeners = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "loadtest_asb_listeners",
+		Help: "Service Bus listeners receiving messages.",
+	})
+	MessagesReceived = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_asb_messages_received_total",
+		Help: "Messages received from Service Bus, by topic.",
+	}, []string{"topic"})
+	ReceiveErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadtest_asb_receive_errors_total",
+		Help: "Failures to receive or complete a Service Bus message, by topic and operation.",
+	}, []string{"topic", "operation"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// channelDepth returns the number of messages waiting in the channel watched last, if any.
+var channelDepth atomic.Pointer[func() int]
+
+var _ = factory.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "loadtest_message_channel_depth",
+	Help: "Messages received from Service Bus and waiting to be correlated.",
+}, func() float64 {
+	if depth := channelDepth.Load(); depth != nil {
+		return float64((*depth)())
+	}
+	return 0
+})
+
+// WatchChannel reports the number of messages waiting in the channel between the listeners and the
+// correlation, as returned by depth, replacing the channel watched before.
+func WatchChannel(depth func() int) {
+	channelDepth.Store(&depth)
+}
+
+// Serve exposes the metrics on /metrics at addr until ctx is done.
+func Serve(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"apim-multi-tenant-asb-load-test/apis"
+	"apim-multi-tenant-asb-load-test/asb_client"
+	"apim-multi-tenant-asb-load-test/auth"
+	"apim-multi-tenant-asb-load-test/config"
+	"apim-multi-tenant-asb-load-test/dashboard"
+	"apim-multi-tenant-asb-load-test/messaging"
+	"apim-multi-tenant-asb-load-test/metrics"
+	"apim-multi-tenant-asb-load-test/report"
+	"apim-multi-tenant-asb-load-test/results"
+	"apim-multi-tenant-asb-load-test/state"
+	"apim-multi-tenant-asb-load-test/utils"
+	"apim-multi-tenant-asb-load-test/worker"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stateFlushInterval is how often a run saves the changes its operations make to the state. A crash
+// loses at most the changes of the last interval.
+const stateFlushInterval = 5 * time.Second
+
+// newClient returns an APIM client authenticated as configured that logs to logger.
+func newClient(cfg *config.Config, logger *log.Logger) (*apis.Client, error) {
+	httpClient, err := apis.NewHTTPClient(cfg.APIM)
+	if err != nil {
+		return nil, err
+	}
+	publisher, err := auth.Publisher(cfg.APIM, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return apis.NewClient(cfg.APIM, httpClient, publisher, auth.Admin(cfg.APIM), logger), nil
+}
+
+// provisionCommand generates tenants and creates their environments. Existing tenants are reused
+// unless -regenerate is given, so a failed provisioning run can be retried against the same orgs.
+func provisionCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	regenerate := fs.Bool("regenerate", false, "generate fresh tenants even if the state file already has some")
+
+	return func(ctx context.Context, cfg *config.Config) error {
+		store, err := state.Open(cfg.Files.State)
+		if err != nil {
+			return err
+		}
+
+		if *regenerate || len(store.Tenants()) == 0 {
+			tenants := utils.GenerateTenants(cfg.Tenants)
+			if err := store.Update(func(run *state.Run) { run.Tenants = tenants }); err != nil {
+				return err
+			}
+			log.Printf("Organization IDs and Data Plane IDs generated and saved to %s\n", store.Path())
+		} else {
+			log.Printf("Reusing %d tenants from %s\n", len(store.Tenants()), store.Path())
+		}
+
+		client, err := newClient(cfg, log.Default())
+		if err != nil {
+			return err
+		}
+
+		utils.CreateEnvironments(ctx, store, client, cfg.Parallelism)
+		log.Printf("Environments created and saved to %s\n", store.Path())
+		return nil
+	}
+}
+
+// registerTopicsCommand registers dataplane topics for every tenant that has none yet.
+func registerTopicsCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	return func(ctx context.Context, cfg *config.Config) error {
+		store, err := state.Open(cfg.Files.State)
+		if err != nil {
+			return err
+		}
+
+		client, err := newClient(cfg, log.Default())
+		if err != nil {
+			return err
+		}
+
+		utils.RegisterTopics(ctx, store, client, cfg.Parallelism)
+		log.Printf("Topics created and saved to %s\n", store.Path())
+		return nil
+	}
+}
+
+// createAPIsCommand creates an API and a revision for every tenant that has none yet.
+func createAPIsCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	return func(ctx context.Context, cfg *config.Config) error {
+		store, err := state.Open(cfg.Files.State)
+		if err != nil {
+			return err
+		}
+
+		client, err := newClient(cfg, log.Default())
+		if err != nil {
+			return err
+		}
+
+		CreateApisAndRevisions(ctx, store, client, cfg.Revisions, cfg.Parallelism)
+		log.Printf("APIs and revisions created and saved to %s\n", store.Path())
+		return nil
+	}
+}
+
+// runCommand issues the configured mix of operations following the load profile and measures how
+// long their gateway events take to arrive. It returns once the profile has ended or the run is interrupted.
+func runCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	return func(ctx context.Context, cfg *config.Config) error {
+		store, err := state.Open(cfg.Files.State)
+		if err != nil {
+			return err
+		}
+		tenants := worker.Deployable(store.Tenants())
+		if len(tenants) == 0 {
+			return fmt.Errorf("no API revisions to deploy in %s, run create-apis first", store.Path())
+		}
+		single := 0
+		for _, tenant := range tenants {
+			if len(tenant.APIs[0].Revisions) == 1 {
+				single++
+			}
+		}
+		if single > 0 {
+			log.Printf("%d tenants have a single revision and will redeploy it; rerun create-apis with -revisions to add more\n", single)
+		}
+		// With the dashboard the terminal shows nothing else: the output of the run goes to the run log.
+		logger := log.Default()
+		if cfg.Dashboard {
+			runLog, err := os.Create(cfg.Files.RunLog)
+			if err != nil {
+				return fmt.Errorf("failed to create file: %w", err)
+			}
+			defer runLog.Close()
+			logger = log.New(runLog, "", log.LstdFlags)
+		}
+		client, err := newClient(cfg, logger)
+		if err != nil {
+			return err
+		}
+
+		seed := cfg.Workload.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		profile := worker.NewProfile(cfg.Workload)
+		arrivals, err := worker.NewArrivals(cfg.Workload, profile, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			return err
+		}
+		// Tenants are selected from a stream of their own, so changing the strategy leaves the arrival
+		// times of a seed unchanged.
+		selector, err := worker.NewSelector(cfg.Workload.Selection, tenants, rand.New(rand.NewSource(seed+1)))
+		if err != nil {
+			return err
+		}
+		mix := worker.NewMix(cfg.Workload.Operations, rand.New(rand.NewSource(seed+2)))
+
+		if cfg.Metrics.Address != "" {
+			// Serve until the run ends, including the drain window after an interrupt.
+			metricsCtx, stopMetrics := context.WithCancel(context.WithoutCancel(ctx))
+			defer stopMetrics()
+			if err := metrics.Serve(metricsCtx, cfg.Metrics.Address); err != nil {
+				return err
+			}
+		}
+
+		// Create a buffered channel for messages.
+		messageChan := make(chan asb_client.Message, cfg.Messaging.BufferSize)
+		metrics.WatchChannel(func() int { return len(messageChan) })
+
+		sink, err := results.Create(cfg.Files.ResultsFormat, cfg.Files.Results)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := sink.Close(); err != nil {
+				log.Printf("Failed to close %s: %v", cfg.Files.Results, err)
+			}
+		}()
+
+		lostFile, err := os.Create(cfg.Files.LostDeployments)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		defer lostFile.Close()
+
+		tenantFile, err := os.Create(cfg.Files.TenantDeployments)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		defer tenantFile.Close()
+
+		collector := report.NewCollector(store.Tenants())
+		runID := time.Now().UTC().Format("20060102T150405Z")
+		logger.Printf("Run %s: writing results to %s\n", runID, cfg.Files.Results)
+		records := messaging.NewCorrelator(cfg.Messaging.ExpireAfter, store.Tenants(), collector, sink, runID, logger)
+
+		// Create a wait group to synchronize the listeners.
+		var wg sync.WaitGroup
+
+		// The listeners outlive an interrupt, so events of deployments already issued can still be
+		// received during the drain window. They are stopped explicitly afterwards. They record their
+		// subscriptions on the tenants' topics, so they start once the collector and the correlator have
+		// read them.
+		listenCtx, stopListeners := context.WithCancel(context.WithoutCancel(ctx))
+		defer stopListeners()
+
+		// Changes the operations make to the tenants' APIs are saved in batches until the listeners
+		// stopped.
+		flushCtx, stopFlush := context.WithCancel(context.Background())
+		defer stopFlush()
+		flushDone := make(chan struct{})
+		go func() {
+			defer close(flushDone)
+			store.FlushEvery(flushCtx, stateFlushInterval, logger)
+		}()
+
+		messaging.CreateTopicListeners(listenCtx, store, messageChan, &wg, logger)
+
+		// Start a goroutine to listen on the common channel.
+		listener := messaging.NewListener(records, cfg.Messaging.LateThreshold, cfg.Dashboard, logger)
+		listenDone := make(chan messaging.ListenStats)
+		go func() {
+			listenDone <- listener.ListenToChannel(messageChan)
+		}()
+
+		// Operations still waiting for their event after expireAfter are lost even while the run goes on.
+		lost := 0
+		sweepCtx, stopSweep := context.WithCancel(context.Background())
+		defer stopSweep()
+		sweepDone := make(chan struct{})
+		go func() {
+			defer close(sweepDone)
+			records.Sweep(sweepCtx, max(cfg.Messaging.ExpireAfter/10, time.Second), func(expired []*messaging.Record) {
+				lost += len(expired)
+				if err := messaging.WriteLost(lostFile, expired); err != nil {
+					logger.Printf("Failed to write %s: %v", lostFile.Name(), err)
+				}
+			})
+		}()
+
+		if total, bounded := profile.Duration(); bounded {
+			logger.Printf("Starting %s operations for %s...\n", cfg.Workload.Arrival, total)
+		} else {
+			logger.Printf("Starting %s operations until interrupted...\n", cfg.Workload.Arrival)
+		}
+		generator := worker.NewGenerator(client, store, tenants, selector, mix, arrivals, profile, cfg.DeployConcurrency, cfg.Revisions.Limit, records, logger)
+		dashboardCtx, stopDashboard := context.WithCancel(context.Background())
+		defer stopDashboard()
+		dashboardDone := make(chan struct{})
+		if cfg.Dashboard {
+			go func() {
+				defer close(dashboardDone)
+				dashboard.New(os.Stdout, runID, generator, listener, collector).Run(dashboardCtx)
+			}()
+		} else {
+			close(dashboardDone)
+		}
+		stats := generator.Run(ctx, cfg.Workload.ReportInterval)
+
+		logger.Printf("Operations finished: %s\n", stats)
+		for _, segment := range stats.Segments {
+			logger.Printf("  %s\n", segment)
+		}
+		for _, op := range stats.Operations {
+			if op.Issued+op.Dropped > 0 {
+				logger.Printf("  %s\n", op)
+			}
+		}
+		logger.Printf("Tenant selection %s: busiest 5%% of %d tenants received %.1f%% of the deployments\n",
+			cfg.Workload.Selection.Strategy, len(stats.Tenants), 100*stats.TopShare(0.05))
+		if err := writeTenantDeployments(tenantFile, stats.Tenants); err != nil {
+			logger.Printf("Failed to write %s: %v", tenantFile.Name(), err)
+		}
+
+		// Keep receiving so events of the last deployments can still arrive. A second interrupt skips
+		// the rest of the window.
+		if cfg.Messaging.DrainWindow > 0 {
+			logger.Printf("Draining events for %s...\n", cfg.Messaging.DrainWindow)
+			interrupted, stopInterrupt := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			select {
+			case <-time.After(cfg.Messaging.DrainWindow):
+			case <-interrupted.Done():
+			}
+			stopInterrupt()
+		}
+		stopDashboard()
+		<-dashboardDone
+
+		// Stop the listeners, wait for them to close their receivers and for the remaining messages to
+		// be processed.
+		stopListeners()
+		wg.Wait()
+		stopFlush()
+		<-flushDone
+		close(messageChan)
+		events := <-listenDone
+		stopSweep()
+		<-sweepDone
+		remaining := records.Drain()
+		if err := messaging.WriteLost(lostFile, remaining); err != nil {
+			log.Printf("Failed to write %s: %v", lostFile.Name(), err)
+		}
+		lost += len(remaining)
+
+		for _, file := range []*os.File{lostFile, tenantFile} {
+			if err := file.Sync(); err != nil {
+				log.Printf("Failed to flush %s: %v", file.Name(), err)
+			}
+		}
+
+		log.Printf("Run complete: %d operations issued, %d failed, %d dropped; %d events received, %d matched (%d late), %d duplicate, %d unmatched, %d for unknown APIs, %d leaked; %d operations lost\n",
+			stats.Issued, stats.Failed, stats.Dropped, events.Received, events.Matched, events.Late, events.Duplicates, events.Unmatched, events.Unknown, events.Leaked, lost)
+		log.Printf("Service Bus: %d messages redelivered after their lock expired, %d with an ID received before, %d undecodable\n",
+			events.Redeliveries, events.Redelivered, events.Undecodable)
+		for _, op := range stats.Operations {
+			if op.Succeeded > 0 {
+				log.Printf("  %s: %d succeeded, %d events matched\n", op.EventType, op.Succeeded, events.ByEventType[op.EventType])
+			}
+		}
+
+		if err := writeLatencyReport(cfg.Files.LatencyReport, collector); err != nil {
+			log.Printf("Failed to write %s: %v", cfg.Files.LatencyReport, err)
+		}
+
+		if err := writeHTMLReport(cfg); err != nil {
+			log.Printf("Failed to write %s: %v", cfg.Files.HTMLReport, err)
+		} else {
+			log.Printf("Report written to %s\n", cfg.Files.HTMLReport)
+		}
+
+		// An event on another tenant's topic breaks isolation, which fails the run however well
+		// everything else went.
+		leaks := records.Leaks()
+		leakFile, err := os.Create(cfg.Files.Leaks)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		defer leakFile.Close()
+		if err := messaging.WriteLeaks(leakFile, leaks); err != nil {
+			log.Printf("Failed to write %s: %v", leakFile.Name(), err)
+		}
+		if err := leakFile.Sync(); err != nil {
+			log.Printf("Failed to flush %s: %v", leakFile.Name(), err)
+		}
+		if len(leaks) > 0 {
+			for _, leak := range leaks {
+				log.Printf("  %s\n", leak)
+			}
+			return fmt.Errorf("tenant isolation broken: %d events arrived on another tenant's topic, see %s", len(leaks), cfg.Files.Leaks)
+		}
+		log.Printf("Tenant isolation held: no event arrived on another tenant's topic\n")
+		return nil
+	}
+}
+
+// writeLatencyReport prints the latency summary of the run and of its stages, its slowest tenants and
+// topics and those with the most lost, duplicate or unexpected events, and saves it with every tenant
+// and topic to path.
+func writeLatencyReport(path string, collector *report.Collector) error {
+	const slowest = 10
+	overall, tenants, topics := collector.Summaries()
+
+	breakdown := collector.Breakdown()
+
+	fmt.Println()
+	report.WriteTable(os.Stdout, "Latency from operation to event:", []report.Summary{overall})
+	report.WriteTable(os.Stdout, "Latency by stage:", breakdown)
+	report.WriteTable(os.Stdout, fmt.Sprintf("Slowest tenants (%d of %d):", min(slowest, len(tenants)), len(tenants)), tenants[:min(slowest, len(tenants))])
+	report.WriteTable(os.Stdout, fmt.Sprintf("Slowest topics (%d of %d):", min(slowest, len(topics)), len(topics)), topics[:min(slowest, len(topics))])
+	if anomalies := report.Anomalies(tenants); len(anomalies) > 0 {
+		report.WriteTable(os.Stdout, fmt.Sprintf("Tenants with lost, duplicate or unexpected events (%d of %d):", min(slowest, len(anomalies)), len(anomalies)), anomalies[:min(slowest, len(anomalies))])
+	}
+	if anomalies := report.Anomalies(topics); len(anomalies) > 0 {
+		report.WriteTable(os.Stdout, fmt.Sprintf("Topics with lost, duplicate or unexpected events (%d of %d):", min(slowest, len(anomalies)), len(anomalies)), anomalies[:min(slowest, len(anomalies))])
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, table := range []struct {
+		title     string
+		summaries []report.Summary
+	}{
+		{"Overall:", []report.Summary{overall}},
+		{"By stage:", breakdown},
+		{"Per tenant:", tenants},
+		{"Per topic:", topics},
+	} {
+		if err := report.WriteTable(file, table.title, table.summaries); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(file); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// writeTenantDeployments writes one CSV line per tenant with the deployments that went to it.
+func writeTenantDeployments(file *os.File, tenants []worker.TenantStats) error {
+	if _, err := file.WriteString("orgId,issued,dropped,succeeded,failed\n"); err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		if _, err := fmt.Fprintf(file, "%s,%d,%d,%d,%d\n", tenant.OrgID, tenant.Issued, tenant.Dropped, tenant.Succeeded, tenant.Failed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportCommand rebuilds the HTML report of the last run, e.g. after changing the report or to
+// view the results of an interrupted run.
+func reportCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	return func(ctx context.Context, cfg *config.Config) error {
+		if err := writeHTMLReport(cfg); err != nil {
+			return err
+		}
+		log.Printf("Report written to %s\n", cfg.Files.HTMLReport)
+		return nil
+	}
+}
+
+// writeHTMLReport builds the HTML report of a run from its results and state files.
+func writeHTMLReport(cfg *config.Config) error {
+	all, err := results.Read(cfg.Files.ResultsFormat, cfg.Files.Results)
+	if err != nil {
+		return err
+	}
+	redacted, err := cfg.Redacted()
+	if err != nil {
+		return err
+	}
+	store, err := state.Open(cfg.Files.State)
+	if err != nil {
+		return err
+	}
+	run := report.Run{Config: redacted, Tenants: store.Tenants(), Results: all}
+
+	file, err := os.Create(cfg.Files.HTMLReport)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	if err := report.WriteHTML(file, run); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return file.Sync()
+}
+
+// teardownCommand removes everything the run created and reports what could not be removed.
+func teardownCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	reportFile := fs.String("report", "teardown_failures.txt", "file to write the resources that could not be removed to")
+
+	return func(ctx context.Context, cfg *config.Config) error {
+		store, err := state.Open(cfg.Files.State)
+		if err != nil {
+			return err
+		}
+
+		client, err := newClient(cfg, log.Default())
+		if err != nil {
+			return err
+		}
+
+		failures := utils.Teardown(ctx, store, client, cfg.Parallelism)
+		if len(failures) == 0 {
+			log.Printf("Teardown complete, all resources in %s were removed\n", store.Path())
+			return nil
+		}
+
+		lines := make([]string, 0, len(failures))
+		for _, failure := range failures {
+			lines = append(lines, failure.String())
+		}
+		if err := utils.SaveLinesToFile(*reportFile, lines); err != nil {
+			log.Printf("Failed to write teardown report: %v", err)
+		}
+		return fmt.Errorf("%d resources could not be removed, see %s; rerun teardown to retry them", len(failures), *reportFile)
+	}
+}
+
+// migrateStateCommand builds a state file from the text files written by earlier versions of the tool.
+func migrateStateCommand(fs *flag.FlagSet) func(ctx context.Context, cfg *config.Config) error {
+	orgIDsFile := fs.String("org-ids", "organization_ids.txt", "legacy file with <org_id>,<dataplane_id> lines")
+	topicsFile := fs.String("topics", "topics.txt", "legacy file with alternating topic and connection string lines")
+	apiIDsFile := fs.String("api-ids", "api_ids.txt", "legacy file with <org_id>,<dataplane_id>,<api_id>,<revision_id> lines")
+	force := fs.Bool("force", false, "overwrite an existing state file")
+
+	return func(ctx context.Context, cfg *config.Config) error {
+		if _, err := os.Stat(cfg.Files.State); err == nil && !*force {
+			return fmt.Errorf("state file %s already exists, use -force to overwrite it", cfg.Files.State)
+		}
+
+		pairs, err := utils.ReadOrgAndDataPlaneIDs(*orgIDsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read organization IDs: %w", err)
+		}
+		var topics [][2]string
+		if _, err := os.Stat(*topicsFile); err == nil {
+			if topics, err = utils.ReadAsbTopicAndConnectionStringsFromFile(*topicsFile); err != nil {
+				return err
+			}
+		}
+		var apiRows [][]string
+		if _, err := os.Stat(*apiIDsFile); err == nil {
+			if apiRows, err = utils.LoadAPIData(*apiIDsFile); err != nil {
+				return err
+			}
+		}
+
+		run := state.FromLegacy(pairs, topics, apiRows)
+		store, err := state.Open(cfg.Files.State)
+		if err != nil {
+			return err
+		}
+		if err := store.Replace(run); err != nil {
+			return err
+		}
+
+		log.Printf("Migrated %d tenants, %d APIs and %d topics to %s\n", len(run.Tenants), len(apiRows), len(topics), store.Path())
+		if len(run.UnassignedTopics) > 0 {
+			log.Printf("%d topics could not be linked to a tenant and were stored as unassigned\n", len(run.UnassignedTopics))
+		}
+		return nil
+	}
+}
+
+// CreateApisAndRevisions creates an API and revisions.PerAPI revisions for every tenant that doesn't
+// have them yet and records them in the store.
+func CreateApisAndRevisions(ctx context.Context, store *state.Store, client *apis.Client, revisions config.RevisionsConfig, maxParallel int) {
+	var wg sync.WaitGroup
+
+	// Create a semaphore to control the number of parallel goroutines.
+	sem := make(chan struct{}, maxParallel)
+
+	for _, tenant := range store.Tenants() {
+		if len(tenant.APIs) > 0 && len(tenant.APIs[0].Revisions) >= revisions.PerAPI {
+			continue
+		}
+		// Stop starting new tenants once the context is cancelled.
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(tenant *state.Tenant) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Record the API before its revisions, so a rerun doesn't create a second API.
+			if len(tenant.APIs) == 0 {
+				name := fmt.Sprintf("location%s", tenant.OrgID[len(tenant.OrgID)-6:])
+				apiID, err := client.CreateAPI(ctx, name, tenant.OrgID)
+				if err != nil {
+					fmt.Printf("Failed to create API for %s: %v\n", name, err)
+					return
+				}
+				if err := store.Update(func(*state.Run) { tenant.APIs = append(tenant.APIs, state.API{ID: apiID, Name: name}) }); err != nil {
+					fmt.Printf("Failed to save API %s: %v\n", apiID, err)
+					return
+				}
+			}
+
+			api := &tenant.APIs[0]
+			for len(api.Revisions) < revisions.PerAPI {
+				description := fmt.Sprintf("revision %d", len(api.Revisions)+1)
+				revisionID, err := client.CreateRevision(ctx, api.ID, tenant.OrgID, description)
+				// APIM may hold revisions the state doesn't know about, e.g. from an interrupted run or
+				// a limit lower than revisions.limit.
+				if apis.IsRevisionLimit(err) {
+					deleted, delErr := utils.DeleteOldestRevision(ctx, client, tenant.OrgID, api.ID)
+					if delErr != nil {
+						fmt.Printf("Failed to make room for a revision of API %s: %v\n", api.ID, delErr)
+						return
+					}
+					if err := store.Update(func(*state.Run) { api.Revisions = utils.WithoutRevision(api.Revisions, deleted) }); err != nil {
+						fmt.Printf("Failed to save API %s: %v\n", api.ID, err)
+						return
+					}
+					revisionID, err = client.CreateRevision(ctx, api.ID, tenant.OrgID, description)
+				}
+				if err != nil {
+					fmt.Printf("Failed to create revision for API %s: %v\n", api.ID, err)
+					return
+				}
+				if err := store.Update(func(*state.Run) { api.Revisions = append(api.Revisions, state.Revision{ID: revisionID}) }); err != nil {
+					fmt.Printf("Failed to save revision for API %s: %v\n", api.ID, err)
+					return
+				}
+			}
+		}(tenant)
+	}
+
+	wg.Wait()
+	fmt.Println("Finished creating APIs and their revisions.")
+}
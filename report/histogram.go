@@ -0,0 +1,111 @@
+package report
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBuckets is the number of linear buckets per power of two. Values are kept with a relative error
+// below 1/subBuckets, about 1.6%.
+const (
+	subBucketBits = 6
+	subBuckets    = 1 << subBucketBits
+)
+
+// Histogram records durations in log-linear buckets in the manner of an HDR histogram: values below
+// 2*subBuckets microseconds are exact, larger ones are kept within 1/subBuckets of their value. Min
+// and max are exact. A Histogram is not safe for concurrent use.
+type Histogram struct {
+	counts []int64
+	total  int64
+	min    int64
+	max    int64
+}
+
+// Record adds a duration to the histogram. Negative durations, which clock skew can produce, count
+// as zero.
+func (h *Histogram) Record(d time.Duration) {
+	v := max(d.Microseconds(), 0)
+	i := bucketOf(v)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	h.max = max(h.max, v)
+	h.total++
+}
+
+// Merge adds the values recorded in other.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.total == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]int64, len(other.counts)-len(h.counts))...)
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	h.max = max(h.max, other.max)
+	h.total += other.total
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Min returns the smallest recorded value.
+func (h *Histogram) Min() time.Duration {
+	return time.Duration(h.min) * time.Microsecond
+}
+
+// Max returns the largest recorded value.
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max) * time.Microsecond
+}
+
+// Quantile returns the value below which the fraction q of the recorded values fall, e.g.
+// Quantile(0.99) for the 99th percentile.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := max(int64(math.Ceil(q*float64(h.total))), 1)
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			v := min(max(valueOf(i), h.min), h.max)
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return h.Max()
+}
+
+// bucketOf returns the bucket of a value in microseconds.
+func bucketOf(v int64) int {
+	if v < 2*subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits - 1
+	return 2*subBuckets + (shift-1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// valueOf returns the middle of a bucket in microseconds.
+func valueOf(i int) int64 {
+	if i < 2*subBuckets {
+		return int64(i)
+	}
+	k := i - 2*subBuckets
+	shift := k/subBuckets + 1
+	sub := int64(k%subBuckets + subBuckets)
+	return sub<<shift + (int64(1)<<shift)/2
+}
@@ -0,0 +1,107 @@
+package report
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	// Every value falls in a bucket whose middle is within 1/subBuckets of it, and buckets grow with
+	// their values.
+	last := -1
+	for v := int64(0); v < 1<<24; v += 1 + v/97 {
+		i := bucketOf(v)
+		if i < last {
+			t.Fatalf("bucketOf(%d) = %d, below the bucket of a smaller value %d", v, i, last)
+		}
+		last = i
+		if v < 2*subBuckets {
+			if i != int(v) || valueOf(i) != v {
+				t.Errorf("small value %d is in bucket %d of value %d, want its own", v, i, valueOf(i))
+			}
+			continue
+		}
+		middle := valueOf(i)
+		if diff := float64(middle-v) / float64(v); diff > 1.0/subBuckets || diff < -1.0/subBuckets {
+			t.Errorf("value %d is in bucket %d of value %d, %.1f%% off", v, i, middle, 100*diff)
+		}
+	}
+
+	// The first bucket past the exact ones starts right after them.
+	if got := bucketOf(2 * subBuckets); got != 2*subBuckets {
+		t.Errorf("bucketOf(%d) = %d, want %d", 2*subBuckets, got, 2*subBuckets)
+	}
+	if got, want := bucketOf(4*subBuckets), 3*subBuckets; got != want {
+		t.Errorf("bucketOf(%d) = %d, want %d", 4*subBuckets, got, want)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	const us = time.Microsecond
+	tests := []struct {
+		name   string
+		values []time.Duration
+		q      float64
+		want   time.Duration
+	}{
+		{name: "empty", q: 0.5, want: 0},
+		{name: "single value", values: []time.Duration{42 * time.Millisecond}, q: 0.99, want: 42 * time.Millisecond},
+		{name: "exact median", values: []time.Duration{1 * us, 2 * us, 3 * us, 4 * us, 5 * us}, q: 0.5, want: 3 * us},
+		{name: "exact maximum", values: []time.Duration{1 * us, 2 * us, 3 * us, 4 * us, 5 * us}, q: 1, want: 5 * us},
+		{name: "zero quantile is the minimum", values: []time.Duration{7 * us, 9 * us}, q: 0, want: 7 * us},
+		{name: "negative values count as zero", values: []time.Duration{-time.Second, 10 * us}, q: 0.5, want: 0},
+		{
+			name:   "clamped to the maximum",
+			values: []time.Duration{time.Second, time.Second + time.Millisecond},
+			q:      1,
+			want:   time.Second + time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Histogram
+			for _, v := range tt.values {
+				h.Record(v)
+			}
+			if got := h.Quantile(tt.q); got != tt.want {
+				t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuantileAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var h, merged, other Histogram
+	values := make([]time.Duration, 10000)
+	for i := range values {
+		values[i] = time.Duration(rng.ExpFloat64() * float64(500*time.Millisecond))
+		h.Record(values[i])
+		if i%2 == 0 {
+			merged.Record(values[i])
+		} else {
+			other.Record(values[i])
+		}
+	}
+	merged.Merge(&other)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	if h.Count() != int64(len(values)) || merged.Count() != h.Count() {
+		t.Fatalf("Count = %d and %d merged, want %d", h.Count(), merged.Count(), len(values))
+	}
+	if h.Min() != values[0].Truncate(time.Microsecond) || h.Max() != values[len(values)-1].Truncate(time.Microsecond) {
+		t.Errorf("Min, Max = %v, %v, want %v, %v", h.Min(), h.Max(), values[0], values[len(values)-1])
+	}
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99, 0.999} {
+		want := values[int(q*float64(len(values)))-1]
+		got := h.Quantile(q)
+		if diff := float64(got-want) / float64(want); diff > 1.0/subBuckets || diff < -1.0/subBuckets {
+			t.Errorf("Quantile(%v) = %v, want %v within %.1f%%", q, got, want, 100.0/subBuckets)
+		}
+		if merged.Quantile(q) != got {
+			t.Errorf("merged Quantile(%v) = %v, want %v", q, merged.Quantile(q), got)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package report
+
+import (
+	"apim-multi-tenant-asb-load-test/results"
+	"apim-multi-tenant-asb-load-test/state"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Run is what the HTML report of a run is built from.
+type Run struct {
+	// Config is the configuration of the run as YAML, without credentials.
+	Config  string
+	Tenants []*state.Tenant
+	Results []results.Result
+}
+
+// maxListed bounds the lost operations listed one by one in the HTML report.
+const maxListed = 200
+
+// WriteHTML writes a self-contained HTML report of a run to w: its configuration and provisioning,
+// latency over time and its distribution, per tenant and per topic percentiles and what went wrong.
+// The charts are inline SVG, so the file needs nothing else to be viewed.
+func WriteHTML(w io.Writer, run Run) error {
+	return page.Execute(w, newHTMLReport(run))
+}
+
+// htmlReport is the data of the HTML report template.
+type htmlReport struct {
+	RunID       string
+	GeneratedAt time.Time
+	Start, End  time.Time
+	Config      string
+
+	Provisioning []count
+	Operations   []count
+	Events       []count
+
+	LatencyOverTime template.HTML
+	Throughput      template.HTML
+	Distribution    template.HTML
+
+	Overall Summary
+	Stages  []Summary
+	Tenants []Summary
+	Topics  []Summary
+
+	Failures []count
+	Lost     []results.Result
+	LostMore int
+	Leaks    []results.Result
+}
+
+// count is a labelled number in a table of the report.
+type count struct {
+	Label string
+	N     int64
+}
+
+func newHTMLReport(run Run) htmlReport {
+	r := htmlReport{GeneratedAt: time.Now(), Config: run.Config}
+	if len(run.Tenants) > 0 {
+		r.Provisioning = provisioning(run.Tenants)
+	}
+
+	var operations []results.Result
+	var events []results.Result
+	for _, result := range run.Results {
+		if r.RunID == "" {
+			r.RunID = result.RunID
+		}
+		switch result.Kind {
+		case results.KindOperation:
+			operations = append(operations, result)
+			if r.Start.IsZero() || result.SentAt.Before(r.Start) {
+				r.Start = result.SentAt
+			}
+		case results.KindEvent:
+			events = append(events, result)
+		}
+		if end := lastTime(result); end.After(r.End) {
+			r.End = end
+		}
+	}
+
+	r.Operations = countBy(operations, func(result results.Result) string { return result.Outcome })
+	r.Events = countBy(events, func(result results.Result) string { return result.Outcome })
+
+	var overall group
+	var stages [numStages]Histogram
+	tenants := map[string]*group{}
+	topics := map[string]*group{}
+	failures := map[string]int64{}
+	for _, result := range operations {
+		tenant := groupOf(tenants, result.OrgID)
+		if result.HTTPDuration > 0 {
+			stages[StageHTTP].Record(result.HTTPDuration)
+		}
+		switch result.Outcome {
+		case "matched":
+			overall.latency.Record(result.Latency)
+			tenant.latency.Record(result.Latency)
+			if !result.EventAt.IsZero() {
+				stages[StageEmit].Record(result.EventAt.Sub(result.SentAt))
+				if !result.EnqueuedAt.IsZero() {
+					stages[StageEnqueue].Record(result.EnqueuedAt.Sub(result.EventAt))
+				}
+			}
+			if !result.EnqueuedAt.IsZero() {
+				stages[StageReceive].Record(result.ReceivedAt.Sub(result.EnqueuedAt))
+			}
+		case "lost":
+			overall.lost++
+			tenant.lost++
+			if len(r.Lost) < maxListed {
+				r.Lost = append(r.Lost, result)
+			} else {
+				r.LostMore++
+			}
+		case "failed":
+			overall.errors++
+			tenant.errors++
+			failures[failure(result)]++
+		}
+	}
+	for _, result := range events {
+		topic := groupOf(topics, result.Topic)
+		switch result.Outcome {
+		case "matched":
+			topic.latency.Record(result.Latency)
+		case "duplicate":
+			overall.duplicates++
+			topic.duplicates++
+			groupOf(tenants, result.OrgID).duplicates++
+		case "unmatched":
+			overall.unmatched++
+			topic.unmatched++
+		case "unknown":
+			overall.unknown++
+			topic.unknown++
+		case "leaked":
+			r.Leaks = append(r.Leaks, result)
+		}
+	}
+
+	r.Overall = overall.summary("overall")
+	for stage := range numStages {
+		g := group{latency: stages[stage]}
+		r.Stages = append(r.Stages, g.summary(stage.String()))
+	}
+	r.Tenants = summarize(tenants)
+	r.Topics = summarize(topics)
+	for label, n := range failures {
+		r.Failures = append(r.Failures, count{label, n})
+	}
+	sort.Slice(r.Failures, func(i, j int) bool { return r.Failures[i].N > r.Failures[j].N })
+
+	r.LatencyOverTime, r.Throughput = timeCharts(r.Start, r.End, operations, events)
+	r.Distribution = distributionChart(operations)
+	return r
+}
+
+// provisioning counts what the provisioning phases created for the run.
+func provisioning(tenants []*state.Tenant) []count {
+	var environments, topics, subscriptions, apis, revisions int64
+	for _, tenant := range tenants {
+		if tenant.Environment.Created {
+			environments++
+		}
+		topics += int64(len(tenant.Topics))
+		for _, topic := range tenant.Topics {
+			subscriptions += int64(len(topic.Subscriptions))
+		}
+		apis += int64(len(tenant.APIs))
+		for _, api := range tenant.APIs {
+			revisions += int64(len(api.Revisions))
+		}
+	}
+	return []count{
+		{"tenants", int64(len(tenants))},
+		{"environments created", environments},
+		{"topics registered", topics},
+		{"subscriptions created", subscriptions},
+		{"APIs", apis},
+		{"revisions", revisions},
+	}
+}
+
+func countBy(all []results.Result, key func(results.Result) string) []count {
+	counts := map[string]int64{}
+	for _, result := range all {
+		counts[key(result)]++
+	}
+	sorted := make([]count, 0, len(counts))
+	for label, n := range counts {
+		sorted = append(sorted, count{label, n})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].N > sorted[j].N })
+	return sorted
+}
+
+func groupOf(groups map[string]*group, name string) *group {
+	if name == "" {
+		name = unknownTopic
+	}
+	g, ok := groups[name]
+	if !ok {
+		g = &group{}
+		groups[name] = g
+	}
+	return g
+}
+
+// failure describes why an operation failed, by HTTP status and error.
+func failure(result results.Result) string {
+	status := "no response"
+	if result.HTTPStatus != 0 {
+		status = fmt.Sprintf("HTTP %d", result.HTTPStatus)
+	}
+	message := result.Error
+	if len(message) > 160 {
+		message = message[:160] + "..."
+	}
+	return fmt.Sprintf("%s: %s", status, message)
+}
+
+func lastTime(result results.Result) time.Time {
+	last := result.SentAt
+	for _, t := range []time.Time{result.EventAt, result.EnqueuedAt, result.ReceivedAt} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// timeCharts returns the latency percentiles and the rates of operations, failures and events over
+// the course of a run, in about a hundred intervals.
+func timeCharts(start, end time.Time, operations, events []results.Result) (template.HTML, template.HTML) {
+	if start.IsZero() || !end.After(start) {
+		return "", ""
+	}
+	step := max(end.Sub(start)/100, time.Second).Round(time.Second)
+	n := int(end.Sub(start)/step) + 1
+	latencies := make([]Histogram, n)
+	issued := make([]float64, n)
+	failed := make([]float64, n)
+	received := make([]float64, n)
+	slot := func(t time.Time) int {
+		return min(max(int(t.Sub(start)/step), 0), n-1)
+	}
+	for _, result := range operations {
+		i := slot(result.SentAt)
+		issued[i]++
+		switch result.Outcome {
+		case "matched":
+			latencies[i].Record(result.Latency)
+		case "failed":
+			failed[i]++
+		}
+	}
+	for _, result := range events {
+		received[slot(result.ReceivedAt)]++
+	}
+
+	p50 := series{Name: "p50", Color: "#4c78a8"}
+	p95 := series{Name: "p95", Color: "#f58518"}
+	p99 := series{Name: "p99", Color: "#e45756"}
+	for i := range latencies {
+		if latencies[i].Count() == 0 {
+			continue
+		}
+		x := (time.Duration(i) * step).Seconds()
+		p50.Points = append(p50.Points, point{x, latencies[i].Quantile(0.5).Seconds()})
+		p95.Points = append(p95.Points, point{x, latencies[i].Quantile(0.95).Seconds()})
+		p99.Points = append(p99.Points, point{x, latencies[i].Quantile(0.99).Seconds()})
+	}
+
+	rate := func(name, color string, counts []float64) series {
+		s := series{Name: name, Color: color}
+		for i, c := range counts {
+			s.Points = append(s.Points, point{(time.Duration(i) * step).Seconds(), c / step.Seconds()})
+		}
+		return s
+	}
+	latency := lineChart([]series{p50, p95, p99}, "latency (s) of operations sent at", "%.2fs")
+	throughput := lineChart([]series{
+		rate("issued", "#4c78a8", issued),
+		rate("events received", "#54a24b", received),
+		rate("failed", "#e45756", failed),
+	}, "per second", "%.1f/s")
+	return latency, throughput
+}
+
+// distributionBounds are the upper bounds of the bars of the latency distribution.
+var distributionBounds = []time.Duration{
+	50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second,
+	30 * time.Second, time.Minute, 2 * time.Minute, 5 * time.Minute,
+}
+
+// distributionChart returns a bar chart of the number of operations by latency.
+func distributionChart(operations []results.Result) template.HTML {
+	counts := make([]float64, len(distributionBounds)+1)
+	total := 0
+	for _, result := range operations {
+		if result.Outcome != "matched" {
+			continue
+		}
+		i := sort.Search(len(distributionBounds), func(i int) bool { return result.Latency <= distributionBounds[i] })
+		counts[i]++
+		total++
+	}
+	if total == 0 {
+		return ""
+	}
+	labels := make([]string, len(counts))
+	for i, bound := range distributionBounds {
+		labels[i] = "≤" + bound.String()
+	}
+	labels[len(labels)-1] = ">" + distributionBounds[len(distributionBounds)-1].String()
+	return barChart(labels, counts)
+}
+
+// Chart geometry, in SVG user units.
+const (
+	chartWidth  = 960
+	chartHeight = 300
+	marginLeft  = 70
+	marginRight = 20
+	marginTop   = 20
+	marginBelow = 50
+	plotWidth   = chartWidth - marginLeft - marginRight
+	plotHeight  = chartHeight - marginTop - marginBelow
+)
+
+type point struct {
+	X, Y float64
+}
+
+type series struct {
+	Name   string
+	Color  string
+	Points []point
+}
+
+// lineChart draws series over the seconds since the start of the run, with a y axis labelled by
+// yFormat.
+func lineChart(all []series, yLabel, yFormat string) template.HTML {
+	var maxX, maxY float64
+	for _, s := range all {
+		for _, p := range s.Points {
+			maxX = math.Max(maxX, p.X)
+			maxY = math.Max(maxY, p.Y)
+		}
+	}
+	if maxX == 0 {
+		maxX = 1
+	}
+	maxY = niceCeiling(maxY)
+	x := func(v float64) float64 { return marginLeft + v/maxX*plotWidth }
+	y := func(v float64) float64 { return marginTop + plotHeight - v/maxY*plotHeight }
+
+	var b strings.Builder
+	openChart(&b)
+	for i := 0; i <= 4; i++ {
+		v := maxY * float64(i) / 4
+		fmt.Fprintf(&b, `<line class="grid" x1="%d" x2="%d" y1="%.1f" y2="%.1f"/>`, marginLeft, chartWidth-marginRight, y(v), y(v))
+		fmt.Fprintf(&b, `<text class="axis" x="%d" y="%.1f" text-anchor="end">%s</text>`, marginLeft-6, y(v)+4, template.HTMLEscapeString(fmt.Sprintf(yFormat, v)))
+	}
+	for i := 0; i <= 6; i++ {
+		v := maxX * float64(i) / 6
+		fmt.Fprintf(&b, `<text class="axis" x="%.1f" y="%d" text-anchor="middle">%s</text>`, x(v), marginTop+plotHeight+18,
+			(time.Duration(v) * time.Second).Round(time.Second))
+	}
+	fmt.Fprintf(&b, `<text class="axis" x="%d" y="%d">%s, by time since the start of the run</text>`, marginLeft, chartHeight-8, template.HTMLEscapeString(yLabel))
+	for i, s := range all {
+		if len(s.Points) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="`, s.Color)
+		for _, p := range s.Points {
+			fmt.Fprintf(&b, "%.1f,%.1f ", x(p.X), y(p.Y))
+		}
+		b.WriteString(`"/>`)
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text class="axis" x="%d" y="%d">%s</text>`,
+			chartWidth-marginRight-150, marginTop+i*16, s.Color, chartWidth-marginRight-135, marginTop+i*16+9, template.HTMLEscapeString(s.Name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// barChart draws one labelled bar per value.
+func barChart(labels []string, values []float64) template.HTML {
+	var maxY float64
+	for _, v := range values {
+		maxY = math.Max(maxY, v)
+	}
+	maxY = niceCeiling(maxY)
+	width := float64(plotWidth) / float64(len(values))
+	y := func(v float64) float64 { return marginTop + plotHeight - v/maxY*plotHeight }
+
+	var b strings.Builder
+	openChart(&b)
+	for i := 0; i <= 4; i++ {
+		v := maxY * float64(i) / 4
+		fmt.Fprintf(&b, `<line class="grid" x1="%d" x2="%d" y1="%.1f" y2="%.1f"/>`, marginLeft, chartWidth-marginRight, y(v), y(v))
+		fmt.Fprintf(&b, `<text class="axis" x="%d" y="%.1f" text-anchor="end">%.0f</text>`, marginLeft-6, y(v)+4, v)
+	}
+	for i, v := range values {
+		left := marginLeft + float64(i)*width
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#4c78a8"><title>%s: %.0f</title></rect>`,
+			left+2, y(v), width-4, marginTop+plotHeight-y(v), template.HTMLEscapeString(labels[i]), v)
+		fmt.Fprintf(&b, `<text class="axis" x="%.1f" y="%d" text-anchor="middle">%s</text>`, left+width/2, marginTop+plotHeight+18, template.HTMLEscapeString(labels[i]))
+	}
+	fmt.Fprintf(&b, `<text class="axis" x="%d" y="%d">operations by latency from sending to receiving the event</text>`, marginLeft, chartHeight-8)
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func openChart(b *strings.Builder) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="100%%">`, chartWidth, chartHeight)
+	fmt.Fprintf(b, `<rect class="plot" x="%d" y="%d" width="%d" height="%d"/>`, marginLeft, marginTop, plotWidth, plotHeight)
+}
+
+// niceCeiling rounds v up to 1, 2 or 5 times a power of ten, so the axis has round labels.
+func niceCeiling(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if v <= step*magnitude {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ms": Millis,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04:05.000 MST")
+	},
+	"duration": func(start, end time.Time) time.Duration { return end.Sub(start).Round(time.Second) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Load test run {{.RunID}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 1100px; color: #222; }
+h1 { font-size: 1.6em; } h2 { margin-top: 2em; border-bottom: 1px solid #ddd; padding-bottom: .2em; }
+table { border-collapse: collapse; margin: .5em 0; font-size: .9em; }
+th, td { padding: .25em .7em; border-bottom: 1px solid #eee; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f5f5f5; }
+pre { background: #f5f5f5; padding: 1em; overflow-x: auto; font-size: .85em; }
+.fail { color: #c0392b; font-weight: bold; } .ok { color: #27ae60; font-weight: bold; }
+.scroll { max-height: 30em; overflow-y: auto; }
+svg .plot { fill: #fafafa; stroke: #ccc; } svg .grid { stroke: #e5e5e5; } svg .axis { font-size: 11px; fill: #555; }
+</style>
+</head>
+<body>
+<h1>Load test run {{.RunID}}</h1>
+<p>From {{time .Start}} to {{time .End}} ({{duration .Start .End}}). Generated {{time .GeneratedAt}}.</p>
+{{if .Leaks}}<p class="fail">Tenant isolation broken: {{len .Leaks}} events arrived on another tenant's topic.</p>
+{{else}}<p class="ok">Tenant isolation held: no event arrived on another tenant's topic.</p>{{end}}
+
+<h2>Summary</h2>
+<table><tr><th>operations</th><th>count</th></tr>
+{{range .Operations}}<tr><td>{{.Label}}</td><td>{{.N}}</td></tr>{{end}}
+</table>
+<table><tr><th>events</th><th>count</th></tr>
+{{range .Events}}<tr><td>{{.Label}}</td><td>{{.N}}</td></tr>{{end}}
+</table>
+
+<h2>Provisioning</h2>
+{{if .Provisioning}}<table><tr><th>resource</th><th>count</th></tr>
+{{range .Provisioning}}<tr><td>{{.Label}}</td><td>{{.N}}</td></tr>{{end}}
+</table>{{else}}<p>No tenants in the state file.</p>{{end}}
+
+<h2>Latency over time</h2>
+{{if .LatencyOverTime}}{{.LatencyOverTime}}{{else}}<p>No operation received its event.</p>{{end}}
+<h2>Throughput</h2>
+{{if .Throughput}}{{.Throughput}}{{else}}<p>No operations were issued.</p>{{end}}
+
+<h2>Latency distribution</h2>
+{{if .Distribution}}{{.Distribution}}{{end}}
+<table>
+<tr><th>stage</th><th>count</th><th>min</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>p99.9</th><th>max</th></tr>
+{{range .Stages}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{ms .Min}}</td><td>{{ms .P50}}</td><td>{{ms .P90}}</td><td>{{ms .P95}}</td><td>{{ms .P99}}</td><td>{{ms .P999}}</td><td>{{ms .Max}}</td></tr>{{end}}
+{{with .Overall}}<tr><th>sent -> received</th><th>{{.Count}}</th><th>{{ms .Min}}</th><th>{{ms .P50}}</th><th>{{ms .P90}}</th><th>{{ms .P95}}</th><th>{{ms .P99}}</th><th>{{ms .P999}}</th><th>{{ms .Max}}</th></tr>{{end}}
+</table>
+
+<h2>Per tenant</h2>
+<div class="scroll"><table>
+<tr><th>org</th><th>count</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th><th>lost</th><th>dup</th><th>errors</th></tr>
+{{range .Tenants}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{ms .P50}}</td><td>{{ms .P90}}</td><td>{{ms .P95}}</td><td>{{ms .P99}}</td><td>{{ms .Max}}</td><td>{{.Lost}}</td><td>{{.Duplicates}}</td><td>{{.Errors}}</td></tr>{{end}}
+</table></div>
+
+<h2>Per topic</h2>
+<div class="scroll"><table>
+<tr><th>topic</th><th>count</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th><th>dup</th><th>unmatched</th><th>unknown</th></tr>
+{{range .Topics}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{ms .P50}}</td><td>{{ms .P90}}</td><td>{{ms .P95}}</td><td>{{ms .P99}}</td><td>{{ms .Max}}</td><td>{{.Duplicates}}</td><td>{{.Unmatched}}</td><td>{{.Unknown}}</td></tr>{{end}}
+</table></div>
+
+<h2>Errors, lost events and leaks</h2>
+<h3>Failed operations ({{.Overall.Errors}})</h3>
+{{if .Failures}}<div class="scroll"><table><tr><th>failure</th><th>count</th></tr>
+{{range .Failures}}<tr><td>{{.Label}}</td><td>{{.N}}</td></tr>{{end}}
+</table></div>{{else}}<p>None.</p>{{end}}
+<h3>Lost operations ({{.Overall.Lost}})</h3>
+{{if .Lost}}<div class="scroll"><table><tr><th>org</th><th>API</th><th>revision</th><th>event</th><th>segment</th><th>sent</th></tr>
+{{range .Lost}}<tr><td>{{.OrgID}}</td><td>{{.APIID}}</td><td>{{.RevisionID}}</td><td>{{.EventType}}</td><td>{{.Segment}}</td><td>{{time .SentAt}}</td></tr>{{end}}
+</table></div>{{if .LostMore}}<p>... and {{.LostMore}} more, see the results file.</p>{{end}}{{else}}<p>None.</p>{{end}}
+<h3>Leaked events ({{len .Leaks}})</h3>
+{{if .Leaks}}<div class="scroll"><table><tr><th>API</th><th>revision</th><th>event</th><th>topic</th><th>subscription</th><th>message</th><th>emitted</th><th>received</th></tr>
+{{range .Leaks}}<tr><td>{{.APIID}}</td><td>{{.RevisionID}}</td><td>{{.EventType}}</td><td>{{.Topic}}</td><td>{{.Subscription}}</td><td>{{.MessageID}}</td><td>{{time .EventAt}}</td><td>{{time .ReceivedAt}}</td></tr>{{end}}
+</table></div>{{else}}<p>None.</p>{{end}}
+
+<h2>Configuration</h2>
+<pre>{{.Config}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,300 @@
+package report
+
+import (
+	"apim-multi-tenant-asb-load-test/state"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecentWindow is the period the recent latency of a run is summarized over.
+const RecentWindow = 30 * time.Second
+
+// unknownTopic groups the lost and failed operations of tenants whose topic isn't known, and
+// unknownTenant the events of topics no tenant owns.
+const (
+	unknownTopic  = "(unknown)"
+	unknownTenant = "(unknown)"
+)
+
+// Stage is a part of the latency from sending an operation to receiving its event.
+type Stage int
+
+const (
+	// StageHTTP is APIM's answer to the operation.
+	StageHTTP Stage = iota
+	// StageEmit runs from sending the operation to APIM emitting its event.
+	StageEmit
+	// StageEnqueue runs from APIM emitting the event to Service Bus accepting it.
+	StageEnqueue
+	// StageReceive runs from Service Bus accepting the event to the listener receiving it.
+	StageReceive
+	numStages
+)
+
+var stageNames = [numStages]string{"http call", "sent -> emitted", "emitted -> enqueued", "enqueued -> received"}
+
+func (s Stage) String() string {
+	return stageNames[s]
+}
+
+// Summary is the latency distribution and the outcome counts of a group of operations.
+type Summary struct {
+	Name       string
+	Count      int64
+	Min        time.Duration
+	P50        time.Duration
+	P90        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	P999       time.Duration
+	Max        time.Duration
+	Lost       int64
+	Duplicates int64
+	// Unmatched counts events of the run's APIs that matched no operation, Unknown those of APIs the
+	// run never operated on.
+	Unmatched int64
+	Unknown   int64
+	Errors    int64
+}
+
+// group accumulates the outcomes of the operations of a tenant, a topic or the whole run.
+type group struct {
+	latency    Histogram
+	lost       int64
+	duplicates int64
+	unmatched  int64
+	unknown    int64
+	errors     int64
+}
+
+func (g *group) summary(name string) Summary {
+	return Summary{
+		Name:       name,
+		Count:      g.latency.Count(),
+		Min:        g.latency.Min(),
+		P50:        g.latency.Quantile(0.5),
+		P90:        g.latency.Quantile(0.9),
+		P95:        g.latency.Quantile(0.95),
+		P99:        g.latency.Quantile(0.99),
+		P999:       g.latency.Quantile(0.999),
+		Max:        g.latency.Max(),
+		Lost:       g.lost,
+		Duplicates: g.duplicates,
+		Unmatched:  g.unmatched,
+		Unknown:    g.unknown,
+		Errors:     g.errors,
+	}
+}
+
+// Collector gathers the latencies and outcomes of a run overall, per tenant and per topic. Lost
+// and failed operations never reach a topic; they are attributed to the topic the tenant's events
+// last arrived on, or to its only registered topic. The stages of the latency are only collected for
+// the whole run.
+type Collector struct {
+	mu         sync.Mutex
+	overall    group
+	recent     *window
+	stages     [numStages]Histogram
+	tenants    map[string]*group
+	topics     map[string]*group
+	registered map[string][]string
+	owners     map[string]string
+	lastTopic  map[string]string
+}
+
+// NewCollector returns an empty collector for the tenants of a run.
+func NewCollector(tenants []*state.Tenant) *Collector {
+	c := &Collector{
+		recent:     newWindow(RecentWindow),
+		tenants:    map[string]*group{},
+		topics:     map[string]*group{},
+		registered: map[string][]string{},
+		owners:     map[string]string{},
+		lastTopic:  map[string]string{},
+	}
+	for _, tenant := range tenants {
+		for _, topic := range tenant.Topics {
+			c.registered[tenant.OrgID] = append(c.registered[tenant.OrgID], topic.Name)
+			c.owners[topic.Name] = tenant.OrgID
+		}
+	}
+	return c
+}
+
+// Matched records the latency of an operation whose event arrived on topic.
+func (c *Collector) Matched(orgID, topic string, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastTopic[orgID] = topic
+	c.recent.record(time.Now(), latency)
+	for _, g := range c.groups(orgID, topic) {
+		g.latency.Record(latency)
+	}
+}
+
+// Stage records the latency of a stage of an operation.
+func (c *Collector) Stage(stage Stage, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stages[stage].Record(latency)
+}
+
+// Duplicate records an event that arrived again for an operation that was matched already.
+func (c *Collector) Duplicate(orgID, topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups(orgID, topic) {
+		g.duplicates++
+	}
+}
+
+// Lost records an operation whose event never arrived.
+func (c *Collector) Lost(orgID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups(orgID, c.topicOf(orgID)) {
+		g.lost++
+	}
+}
+
+// Failed records an operation APIM rejected.
+func (c *Collector) Failed(orgID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups(orgID, c.topicOf(orgID)) {
+		g.errors++
+	}
+}
+
+// Unexpected records an event that matched no operation, attributed to the tenant that owns the
+// topic it arrived on. unknown tells whether the event's API is one the run never operated on.
+func (c *Collector) Unexpected(topic string, unknown bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID, ok := c.owners[topic]
+	if !ok {
+		orgID = unknownTenant
+	}
+	for _, g := range c.groups(orgID, topic) {
+		if unknown {
+			g.unknown++
+		} else {
+			g.unmatched++
+		}
+	}
+}
+
+// topicOf returns the topic the tenant's events are expected on.
+func (c *Collector) topicOf(orgID string) string {
+	if topic, ok := c.lastTopic[orgID]; ok {
+		return topic
+	}
+	if registered := c.registered[orgID]; len(registered) == 1 {
+		return registered[0]
+	}
+	return unknownTopic
+}
+
+// groups returns the groups an outcome of the tenant on topic counts towards.
+func (c *Collector) groups(orgID, topic string) []*group {
+	tenant, ok := c.tenants[orgID]
+	if !ok {
+		tenant = &group{}
+		c.tenants[orgID] = tenant
+	}
+	byTopic, ok := c.topics[topic]
+	if !ok {
+		byTopic = &group{}
+		c.topics[topic] = byTopic
+	}
+	return []*group{&c.overall, tenant, byTopic}
+}
+
+// Summaries returns the summary of the whole run and those of every tenant and topic, the slowest
+// first.
+func (c *Collector) Summaries() (Summary, []Summary, []Summary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.overall.summary("overall"), summarize(c.tenants), summarize(c.topics)
+}
+
+// Recent returns the summary of the latencies recorded during the last RecentWindow. Only the
+// latency fields are set.
+func (c *Collector) Recent() Summary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recent := group{latency: c.recent.merged(time.Now())}
+	return recent.summary("recent")
+}
+
+// Breakdown returns the summary of every stage of the latency followed by the end-to-end latency of
+// the whole run.
+func (c *Collector) Breakdown() []Summary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	breakdown := make([]Summary, 0, numStages+1)
+	for stage := range numStages {
+		g := group{latency: c.stages[stage]}
+		breakdown = append(breakdown, g.summary(stage.String()))
+	}
+	endToEnd := group{latency: c.overall.latency}
+	return append(breakdown, endToEnd.summary("sent -> received"))
+}
+
+func summarize(groups map[string]*group) []Summary {
+	summaries := make([]Summary, 0, len(groups))
+	for name, g := range groups {
+		summaries = append(summaries, g.summary(name))
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].P99 != summaries[j].P99 {
+			return summaries[i].P99 > summaries[j].P99
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// Anomalies returns the summaries with lost, duplicate, unmatched or unknown events, those with the
+// most first.
+func Anomalies(summaries []Summary) []Summary {
+	var anomalies []Summary
+	for _, s := range summaries {
+		if s.anomalies() > 0 {
+			anomalies = append(anomalies, s)
+		}
+	}
+	sort.SliceStable(anomalies, func(i, j int) bool { return anomalies[i].anomalies() > anomalies[j].anomalies() })
+	return anomalies
+}
+
+func (s Summary) anomalies() int64 {
+	return s.Lost + s.Duplicates + s.Unmatched + s.Unknown
+}
+
+// WriteTable writes summaries as a table with a header, under a title.
+func WriteTable(w io.Writer, title string, summaries []Summary) error {
+	if _, err := fmt.Fprintf(w, "%s\n%-40s %8s %10s %10s %10s %10s %10s %10s %10s %8s %8s %9s %8s %8s\n", title,
+		"name", "count", "min", "p50", "p90", "p95", "p99", "p99.9", "max", "lost", "dup", "unmatched", "unknown", "errors"); err != nil {
+		return err
+	}
+	for _, s := range summaries {
+		if _, err := fmt.Fprintln(w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%-40s %8d %10s %10s %10s %10s %10s %10s %10s %8d %8d %9d %8d %8d", s.Name, s.Count,
+		Millis(s.Min), Millis(s.P50), Millis(s.P90), Millis(s.P95), Millis(s.P99), Millis(s.P999), Millis(s.Max), s.Lost, s.Duplicates, s.Unmatched, s.Unknown, s.Errors)
+}
+
+// Millis formats a duration in milliseconds.
+func Millis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
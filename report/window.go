@@ -0,0 +1,36 @@
+package report
+
+import "time"
+
+// window keeps the values recorded during the last len(slots) seconds, one histogram per second.
+type window struct {
+	slots   []Histogram
+	seconds []int64
+}
+
+func newWindow(d time.Duration) *window {
+	n := max(int(d/time.Second), 1)
+	return &window{slots: make([]Histogram, n), seconds: make([]int64, n)}
+}
+
+// record adds a value recorded at now.
+func (w *window) record(now time.Time, d time.Duration) {
+	second := now.Unix()
+	i := int(second % int64(len(w.slots)))
+	if w.seconds[i] != second {
+		w.slots[i] = Histogram{}
+		w.seconds[i] = second
+	}
+	w.slots[i].Record(d)
+}
+
+// merged returns the values recorded during the window ending at now.
+func (w *window) merged(now time.Time) Histogram {
+	var h Histogram
+	for i := range w.slots {
+		if now.Unix()-w.seconds[i] < int64(len(w.slots)) {
+			h.Merge(&w.slots[i])
+		}
+	}
+	return h
+}
@@ -0,0 +1,148 @@
+package results
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Read returns the results written to path in format, jsonl or csv.
+func Read(format, path string) ([]Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open results: %w", err)
+	}
+	defer file.Close()
+
+	switch format {
+	case "jsonl":
+		return readJSONL(file)
+	case "csv":
+		return readCSV(file)
+	default:
+		return nil, fmt.Errorf("unknown results format %q", format)
+	}
+}
+
+func readJSONL(r io.Reader) ([]Result, error) {
+	var all []Result
+	dec := json.NewDecoder(r)
+	for {
+		var result Result
+		err := dec.Decode(&result)
+		if errors.Is(err, io.EOF) {
+			return all, nil
+		}
+		if err != nil {
+			// The last line of a run that was killed may be incomplete.
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return all, nil
+			}
+			return nil, fmt.Errorf("failed to parse result %d: %w", len(all)+1, err)
+		}
+		all = append(all, result)
+	}
+}
+
+func readCSV(r io.Reader) ([]Result, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	var all []Result
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return all, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read result %d: %w", len(all)+1, err)
+		}
+		// Files written before a column was added lack it.
+		get := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return row[i]
+			}
+			return ""
+		}
+		p := parser{}
+		result := Result{
+			Kind:           get("kind"),
+			RunID:          get("runId"),
+			OrgID:          get("orgId"),
+			DataPlaneID:    get("dataPlaneId"),
+			APIID:          get("apiId"),
+			RevisionID:     get("revisionId"),
+			EventType:      get("eventType"),
+			Segment:        get("segment"),
+			Topic:          get("topic"),
+			Outcome:        get("outcome"),
+			SentAt:         p.time(get("sentAt")),
+			HTTPStatus:     int(p.int(get("httpStatus"))),
+			HTTPDuration:   p.millis(get("httpDurationMs")),
+			Error:          get("error"),
+			EventAt:        p.time(get("eventAt")),
+			EnqueuedAt:     p.time(get("enqueuedAt")),
+			ReceivedAt:     p.time(get("receivedAt")),
+			Latency:        p.millis(get("latencyMs")),
+			Subscription:   get("subscription"),
+			MessageID:      get("messageId"),
+			SequenceNumber: p.int(get("sequenceNumber")),
+			DeliveryCount:  uint32(p.int(get("deliveryCount"))),
+			ContentType:    get("contentType"),
+		}
+		if properties := get("properties"); properties != "" && p.err == nil {
+			p.err = json.Unmarshal([]byte(properties), &result.Properties)
+		}
+		if p.err != nil {
+			return nil, fmt.Errorf("failed to parse result %d: %w", len(all)+1, p.err)
+		}
+		all = append(all, result)
+	}
+}
+
+// parser parses the fields of a result, keeping the first error.
+type parser struct {
+	err error
+}
+
+func (p *parser) time(s string) time.Time {
+	if s == "" || p.err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	p.err = err
+	return t
+}
+
+func (p *parser) millis(s string) time.Duration {
+	if s == "" || p.err != nil {
+		return 0
+	}
+	ms, err := strconv.ParseFloat(s, 64)
+	p.err = err
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (p *parser) int(s string) int64 {
+	if s == "" || p.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	p.err = err
+	return n
+}
@@ -0,0 +1,267 @@
+package results
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of results.
+const (
+	KindOperation = "operation"
+	KindEvent     = "event"
+)
+
+// Result is one operation sent to APIM or one event received from a topic. Fields that don't apply
+// to a result are left empty.
+type Result struct {
+	Kind        string
+	RunID       string
+	OrgID       string
+	DataPlaneID string
+	APIID       string
+	RevisionID  string
+	EventType   string
+	Segment     string
+	Topic       string
+	Outcome     string
+	SentAt      time.Time
+	HTTPStatus  int
+	// HTTPDuration is how long APIM took to answer the operation.
+	HTTPDuration time.Duration
+	Error        string
+	// EventAt is the timestamp APIM put in the event and EnqueuedAt when Service Bus accepted it.
+	EventAt    time.Time
+	EnqueuedAt time.Time
+	ReceivedAt time.Time
+	// Latency is the time from sending the operation to receiving its event.
+	Latency time.Duration
+
+	// Subscription, SequenceNumber, DeliveryCount, ContentType and Properties are the Service Bus
+	// metadata of the message of an event. MessageID is also set on operations whose event arrived.
+	Subscription   string
+	MessageID      string
+	SequenceNumber int64
+	DeliveryCount  uint32
+	ContentType    string
+	Properties     map[string]any
+}
+
+// jsonResult is a Result as written to JSON lines, with the same names and units as the CSV columns.
+type jsonResult struct {
+	Kind           string         `json:"kind"`
+	RunID          string         `json:"runId"`
+	OrgID          string         `json:"orgId,omitempty"`
+	DataPlaneID    string         `json:"dataPlaneId,omitempty"`
+	APIID          string         `json:"apiId,omitempty"`
+	RevisionID     string         `json:"revisionId,omitempty"`
+	EventType      string         `json:"eventType,omitempty"`
+	Segment        string         `json:"segment,omitempty"`
+	Topic          string         `json:"topic,omitempty"`
+	Outcome        string         `json:"outcome"`
+	SentAt         string         `json:"sentAt,omitempty"`
+	HTTPStatus     int            `json:"httpStatus,omitempty"`
+	HTTPDurationMs json.Number    `json:"httpDurationMs,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	EventAt        string         `json:"eventAt,omitempty"`
+	EnqueuedAt     string         `json:"enqueuedAt,omitempty"`
+	ReceivedAt     string         `json:"receivedAt,omitempty"`
+	LatencyMs      json.Number    `json:"latencyMs,omitempty"`
+	Subscription   string         `json:"subscription,omitempty"`
+	MessageID      string         `json:"messageId,omitempty"`
+	SequenceNumber int64          `json:"sequenceNumber,omitempty"`
+	DeliveryCount  uint32         `json:"deliveryCount,omitempty"`
+	ContentType    string         `json:"contentType,omitempty"`
+	Properties     map[string]any `json:"properties,omitempty"`
+}
+
+// MarshalJSON writes the result with the same names and units as the CSV columns, leaving out empty
+// fields.
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonResult{
+		r.Kind, r.RunID, r.OrgID, r.DataPlaneID, r.APIID, r.RevisionID, r.EventType, r.Segment, r.Topic, r.Outcome,
+		formatTime(r.SentAt), r.HTTPStatus, json.Number(formatMillis(r.HTTPDuration)), r.Error,
+		formatTime(r.EventAt), formatTime(r.EnqueuedAt), formatTime(r.ReceivedAt), json.Number(formatMillis(r.Latency)),
+		r.Subscription, r.MessageID, r.SequenceNumber, r.DeliveryCount, r.ContentType, r.Properties,
+	})
+}
+
+// UnmarshalJSON reads a result written by MarshalJSON.
+func (r *Result) UnmarshalJSON(data []byte) error {
+	var j jsonResult
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	p := parser{}
+	*r = Result{
+		Kind:           j.Kind,
+		RunID:          j.RunID,
+		OrgID:          j.OrgID,
+		DataPlaneID:    j.DataPlaneID,
+		APIID:          j.APIID,
+		RevisionID:     j.RevisionID,
+		EventType:      j.EventType,
+		Segment:        j.Segment,
+		Topic:          j.Topic,
+		Outcome:        j.Outcome,
+		SentAt:         p.time(j.SentAt),
+		HTTPStatus:     j.HTTPStatus,
+		HTTPDuration:   p.millis(string(j.HTTPDurationMs)),
+		Error:          j.Error,
+		EventAt:        p.time(j.EventAt),
+		EnqueuedAt:     p.time(j.EnqueuedAt),
+		ReceivedAt:     p.time(j.ReceivedAt),
+		Latency:        p.millis(string(j.LatencyMs)),
+		Subscription:   j.Subscription,
+		MessageID:      j.MessageID,
+		SequenceNumber: j.SequenceNumber,
+		DeliveryCount:  j.DeliveryCount,
+		ContentType:    j.ContentType,
+		Properties:     j.Properties,
+	}
+	return p.err
+}
+
+// Sink receives results. Implementations are safe for concurrent use.
+type Sink interface {
+	Write(r Result) error
+	Close() error
+}
+
+// Create opens a sink writing results in format, jsonl or csv, to path.
+func Create(format, path string) (Sink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	switch format {
+	case "jsonl":
+		return NewJSONL(file), nil
+	case "csv":
+		return NewCSV(file)
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unknown results format %q", format)
+	}
+}
+
+// jsonlSink writes one JSON object per line.
+type jsonlSink struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// NewJSONL returns a sink that writes results to w as JSON lines.
+func NewJSONL(w io.WriteCloser) Sink {
+	return &jsonlSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *jsonlSink) Write(r Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(r)
+}
+
+func (s *jsonlSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// csvHeader names the columns written by the CSV sink. Durations are in milliseconds, times in RFC 3339
+// with nanoseconds and message properties a JSON object.
+var csvHeader = []string{
+	"kind", "runId", "orgId", "dataPlaneId", "apiId", "revisionId", "eventType", "segment", "topic", "outcome",
+	"sentAt", "httpStatus", "httpDurationMs", "error", "eventAt", "enqueuedAt", "receivedAt", "latencyMs",
+	"subscription", "messageId", "sequenceNumber", "deliveryCount", "contentType", "properties",
+}
+
+// csvSink writes one CSV row per result.
+type csvSink struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	cw *csv.Writer
+}
+
+// NewCSV returns a sink that writes results to w as CSV with a header row.
+func NewCSV(w io.WriteCloser) (Sink, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return &csvSink{w: w, cw: cw}, nil
+}
+
+func (s *csvSink) Write(r Result) error {
+	properties, err := formatProperties(r.Properties)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.cw.Write([]string{
+		r.Kind, r.RunID, r.OrgID, r.DataPlaneID, r.APIID, r.RevisionID, r.EventType, r.Segment, r.Topic, r.Outcome,
+		formatTime(r.SentAt), formatInt(r.HTTPStatus), formatMillis(r.HTTPDuration), r.Error,
+		formatTime(r.EventAt), formatTime(r.EnqueuedAt), formatTime(r.ReceivedAt), formatMillis(r.Latency),
+		r.Subscription, r.MessageID, formatInt64(r.SequenceNumber), formatInt(int(r.DeliveryCount)), r.ContentType, properties,
+	})
+	if err != nil {
+		return err
+	}
+	// Flush every row, so the file is usable while a run is still going.
+	s.cw.Flush()
+	return s.cw.Error()
+}
+
+func (s *csvSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cw.Flush()
+	if err := s.cw.Error(); err != nil {
+		s.w.Close()
+		return err
+	}
+	return s.w.Close()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func formatInt(n int) string {
+	return formatInt64(int64(n))
+}
+
+func formatInt64(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func formatProperties(properties map[string]any) (string, error) {
+	if len(properties) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(properties)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode message properties: %w", err)
+	}
+	return string(encoded), nil
+}
+
+func formatMillis(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,82 @@
+package results
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sentAt := time.Date(2025, 1, 1, 12, 0, 0, 123456789, time.UTC)
+	written := []Result{
+		{
+			Kind:         KindOperation,
+			RunID:        "run",
+			OrgID:        "org",
+			DataPlaneID:  "dp",
+			APIID:        "api",
+			RevisionID:   "rev",
+			EventType:    "DEPLOY_API_IN_GATEWAY",
+			Segment:      "ramp",
+			Topic:        "topic",
+			Outcome:      "matched",
+			SentAt:       sentAt,
+			HTTPStatus:   201,
+			HTTPDuration: 80 * time.Millisecond,
+			Error:        "timeout, after \"retry\"\nof 3",
+			EventAt:      sentAt.Add(100 * time.Millisecond),
+			EnqueuedAt:   sentAt.Add(150 * time.Millisecond),
+			ReceivedAt:   sentAt.Add(1500 * time.Millisecond),
+			Latency:      1500 * time.Millisecond,
+			MessageID:    "message",
+		},
+		{
+			Kind:           KindEvent,
+			RunID:          "run",
+			APIID:          "api",
+			EventType:      "DEPLOY_API_IN_GATEWAY",
+			Topic:          "topic",
+			Outcome:        "unknown",
+			ReceivedAt:     sentAt,
+			Subscription:   "subscription",
+			MessageID:      "message",
+			SequenceNumber: 42,
+			DeliveryCount:  2,
+			ContentType:    "application/json",
+			Properties:     map[string]any{"tenant": "org", "attempt": float64(1)},
+		},
+		{Kind: KindOperation, RunID: "run", Outcome: "lost"},
+	}
+
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "results."+format)
+			sink, err := Create(format, path)
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			for _, r := range written {
+				if err := sink.Write(r); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			read, err := Read(format, path)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if len(read) != len(written) {
+				t.Fatalf("read %d results, want %d", len(read), len(written))
+			}
+			for i := range written {
+				if !reflect.DeepEqual(read[i], written[i]) {
+					t.Errorf("result %d:\n got %+v\nwant %+v", i, read[i], written[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the state document format written by this build.
+const Version = 1
+
+// Run is the state of a load test run: every tenant it provisioned and everything created for it.
+type Run struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Tenants   []*Tenant `json:"tenants"`
+	// UnassignedTopics holds migrated topics that could not be linked to a tenant.
+	UnassignedTopics []Topic `json:"unassignedTopics,omitempty"`
+}
+
+// Tenant is a single organization with its dataplane and the resources registered for it.
+type Tenant struct {
+	OrgID       string      `json:"orgId"`
+	DataPlaneID string      `json:"dataPlaneId"`
+	Environment Environment `json:"environment"`
+	Topics      []Topic     `json:"topics,omitempty"`
+	APIs        []API       `json:"apis,omitempty"`
+}
+
+// Environment is the gateway environment created for a tenant's dataplane.
+type Environment struct {
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name"`
+	VHost   string `json:"vhost"`
+	Created bool   `json:"created"`
+}
+
+// Topic is a Service Bus topic registered for a tenant's dataplane.
+type Topic struct {
+	Name             string `json:"name"`
+	ConnectionString string `json:"connectionString"`
+	// Subscriptions are the subscriptions the listeners created on this topic.
+	Subscriptions []string `json:"subscriptions,omitempty"`
+}
+
+// API is an API created in a tenant together with its revisions.
+type API struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Revisions []Revision `json:"revisions,omitempty"`
+	// Status is the lifecycle state the load test last moved the API to. Empty means CREATED.
+	Status string `json:"status,omitempty"`
+}
+
+// Revision is a revision of an API.
+type Revision struct {
+	ID string `json:"id"`
+}
+
+// NewTenant returns a tenant with the environment name and vhost derived from its dataplane ID.
+func NewTenant(orgID, dataPlaneID string) *Tenant {
+	name := fmt.Sprintf("development-%s", dataPlaneID[len(dataPlaneID)-6:])
+	return &Tenant{
+		OrgID:       orgID,
+		DataPlaneID: dataPlaneID,
+		Environment: Environment{
+			Name:  name,
+			VHost: fmt.Sprintf("%s-dev.choreo-dv.pdp.dev", name),
+		},
+	}
+}
+
+// Store holds a run in memory and persists it to a JSON file. Mutations go through Update so that
+// the phases can record progress from many goroutines and a crash loses at most one tenant's work.
+// Hot paths go through Defer instead, whose changes are saved by the next Flush.
+type Store struct {
+	path string
+	mu   sync.Mutex
+	run  *Run
+	// dirty is set while a deferred change is not saved yet.
+	dirty bool
+}
+
+// Open loads the state file at path, or starts an empty run if it does not exist yet.
+func Open(path string) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		now := time.Now().UTC()
+		return &Store{path: path, run: &Run{Version: Version, CreatedAt: now, UpdatedAt: now}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if run.Version > Version {
+		return nil, fmt.Errorf("state file %s has version %d, this build supports up to %d", path, run.Version, Version)
+	}
+	run.Version = Version
+	return &Store{path: path, run: &run}, nil
+}
+
+// Path returns the file the store persists to.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Tenants returns the tenants of the run. The slice is a copy, the tenants are shared.
+func (s *Store) Tenants() []*Tenant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Tenant(nil), s.run.Tenants...)
+}
+
+// Update applies fn to the run under the store lock and saves the result.
+func (s *Store) Update(fn func(run *Run)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.run)
+	return s.save()
+}
+
+// Defer applies fn to the run under the store lock like Update, but leaves saving it to the next
+// Flush.
+func (s *Store) Defer(fn func(run *Run)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.run)
+	s.dirty = true
+}
+
+// Flush saves the run if a deferred change wasn't saved yet.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// FlushEvery flushes the store every interval until ctx is done, and once more then. Failures are
+// logged to logger.
+func (s *Store) FlushEvery(ctx context.Context, interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				logger.Printf("Failed to save state: %v", err)
+			}
+			return
+		}
+		if err := s.Flush(); err != nil {
+			logger.Printf("Failed to save state: %v", err)
+		}
+	}
+}
+
+// Replace swaps the whole run held by the store, used when importing legacy files.
+func (s *Store) Replace(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.run = run
+	return s.save()
+}
+
+// Save writes the run to disk.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// save writes the run to a temporary file and renames it over the state file, so readers never see
+// a partially written document.
+func (s *Store) save() error {
+	s.run.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(s.run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// FromLegacy builds a run from the contents of the old organization_ids.txt, topics.txt and
+// api_ids.txt files. Topics were stored without their tenant, so each one is linked to the tenant
+// whose org or dataplane ID appears in the topic name; the rest are kept as unassigned.
+func FromLegacy(orgDataPlanePairs, topics [][2]string, apiRows [][]string) *Run {
+	now := time.Now().UTC()
+	run := &Run{Version: Version, CreatedAt: now, UpdatedAt: now}
+
+	byOrg := make(map[string]*Tenant)
+	for _, pair := range orgDataPlanePairs {
+		tenant := NewTenant(pair[0], pair[1])
+		// Environments were created for every generated tenant before topics or APIs existed.
+		tenant.Environment.Created = true
+		run.Tenants = append(run.Tenants, tenant)
+		byOrg[tenant.OrgID] = tenant
+	}
+
+	for _, row := range apiRows {
+		tenant, ok := byOrg[row[0]]
+		if !ok {
+			tenant = NewTenant(row[0], row[1])
+			run.Tenants = append(run.Tenants, tenant)
+			byOrg[tenant.OrgID] = tenant
+		}
+		tenant.APIs = append(tenant.APIs, API{
+			ID:        row[2],
+			Name:      fmt.Sprintf("location%s", row[0][len(row[0])-6:]),
+			Revisions: []Revision{{ID: row[3]}},
+		})
+	}
+
+	for _, pair := range topics {
+		topic := Topic{Name: pair[0], ConnectionString: pair[1]}
+		if tenant := findTopicOwner(run.Tenants, topic.Name); tenant != nil {
+			tenant.Topics = append(tenant.Topics, topic)
+		} else {
+			run.UnassignedTopics = append(run.UnassignedTopics, topic)
+		}
+	}
+	return run
+}
+
+// findTopicOwner returns the tenant whose org or dataplane ID is part of the topic name.
+func findTopicOwner(tenants []*Tenant, topicName string) *Tenant {
+	name := strings.ToLower(topicName)
+	for _, tenant := range tenants {
+		if strings.Contains(name, strings.ToLower(tenant.DataPlaneID)) || strings.Contains(name, strings.ToLower(tenant.OrgID)) {
+			return tenant
+		}
+	}
+	return nil
+}
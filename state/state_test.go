@@ -0,0 +1,42 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeferSavesOnFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	store.Defer(func(run *Run) { run.Tenants = append(run.Tenants, NewTenant("org-000001", "dataplane-000001")) })
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file written before Flush: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if tenants := reopened.Tenants(); len(tenants) != 1 || tenants[0].OrgID != "org-000001" {
+		t.Errorf("tenants = %+v, want org-000001", tenants)
+	}
+
+	// Nothing changed since, so another Flush leaves the file alone.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file written by a Flush without changes: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"apim-multi-tenant-asb-load-test/apis"
+	"apim-multi-tenant-asb-load-test/asb_client"
+	"apim-multi-tenant-asb-load-test/state"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// TeardownFailure describes a resource that could not be removed.
+type TeardownFailure struct {
+	OrgID    string
+	Resource string
+	ID       string
+	Err      error
+}
+
+func (f TeardownFailure) String() string {
+	return fmt.Sprintf("org %s: %s %s: %v", f.OrgID, f.Resource, f.ID, f.Err)
+}
+
+// Teardown removes everything a run created for its tenants: deployments, revisions, APIs,
+// environments and the Service Bus subscriptions created by the listeners. Removed resources are
+// dropped from the run state as they go, so a teardown can be rerun to retry what failed.
+func Teardown(ctx context.Context, store *state.Store, client *apis.Client, maxParallel int) []TeardownFailure {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []TeardownFailure
+	)
+	sem := make(chan struct{}, maxParallel)
+
+	fail := func(tenant *state.Tenant, resource, id string, err error) {
+		log.Printf("Failed to remove %s %s for Org: %s: %v", resource, id, tenant.OrgID, err)
+		mu.Lock()
+		failures = append(failures, TeardownFailure{OrgID: tenant.OrgID, Resource: resource, ID: id, Err: err})
+		mu.Unlock()
+	}
+	update := func(tenant *state.Tenant, fn func()) {
+		if err := store.Update(func(*state.Run) { fn() }); err != nil {
+			log.Printf("Failed to save state for Org: %s: %v", tenant.OrgID, err)
+		}
+	}
+
+	for _, tenant := range store.Tenants() {
+		// Stop starting new tenants once the context is cancelled.
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(tenant *state.Tenant) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			teardownAPIs(ctx, tenant, client, fail, update)
+			teardownEnvironment(ctx, tenant, client, fail, update)
+			teardownSubscriptions(ctx, tenant, fail, update)
+		}(tenant)
+	}
+
+	wg.Wait()
+	return failures
+}
+
+// teardownAPIs undeploys every deployed revision of the tenant's APIs, then deletes the revisions and
+// the APIs themselves.
+func teardownAPIs(ctx context.Context, tenant *state.Tenant, client *apis.Client, fail func(*state.Tenant, string, string, error), update func(*state.Tenant, func())) {
+	var remaining []state.API
+	for _, api := range tenant.APIs {
+		deployments, err := client.GetDeployments(ctx, api.ID, tenant.OrgID)
+		if err != nil {
+			fail(tenant, "deployments of API", api.ID, err)
+			remaining = append(remaining, api)
+			continue
+		}
+
+		undeployed := true
+		for _, deployment := range deployments {
+			err := client.UndeployAPIRevision(ctx, api.ID, deployment.RevisionID, tenant.OrgID, deployment.Name, deployment.VHost)
+			if err != nil {
+				fail(tenant, "deployment of revision", deployment.RevisionID, err)
+				undeployed = false
+			}
+		}
+		if !undeployed {
+			remaining = append(remaining, api)
+			continue
+		}
+
+		var revisions []state.Revision
+		for _, revision := range api.Revisions {
+			if err := client.DeleteRevision(ctx, api.ID, revision.ID, tenant.OrgID); err != nil {
+				fail(tenant, "revision", revision.ID, err)
+				revisions = append(revisions, revision)
+			}
+		}
+
+		if err := client.DeleteAPI(ctx, api.ID, tenant.OrgID); err != nil {
+			fail(tenant, "API", api.ID, err)
+			api.Revisions = revisions
+			remaining = append(remaining, api)
+		}
+	}
+
+	update(tenant, func() { tenant.APIs = remaining })
+}
+
+// teardownEnvironment deletes the tenant's environment, looking its ID up by name for state files
+// written before environment IDs were recorded.
+func teardownEnvironment(ctx context.Context, tenant *state.Tenant, client *apis.Client, fail func(*state.Tenant, string, string, error), update func(*state.Tenant, func())) {
+	if !tenant.Environment.Created {
+		return
+	}
+
+	envID := tenant.Environment.ID
+	if envID == "" {
+		id, err := client.FindEnvironment(ctx, tenant.OrgID, tenant.Environment.Name)
+		if err != nil {
+			fail(tenant, "environment", tenant.Environment.Name, err)
+			return
+		}
+		envID = id
+	}
+
+	if envID != "" {
+		if err := client.DeleteEnvironment(ctx, tenant.OrgID, envID); err != nil {
+			fail(tenant, "environment", tenant.Environment.Name, err)
+			return
+		}
+	}
+
+	update(tenant, func() {
+		tenant.Environment.ID = ""
+		tenant.Environment.Created = false
+	})
+}
+
+// teardownSubscriptions deletes the subscriptions the listeners created on the tenant's topics.
+func teardownSubscriptions(ctx context.Context, tenant *state.Tenant, fail func(*state.Tenant, string, string, error), update func(*state.Tenant, func())) {
+	for i := range tenant.Topics {
+		topic := &tenant.Topics[i]
+
+		var remaining []string
+		for _, subscription := range topic.Subscriptions {
+			if err := asb_client.DeleteSubscription(ctx, topic.ConnectionString, topic.Name, subscription); err != nil {
+				fail(tenant, "subscription", topic.Name+"/"+subscription, err)
+				remaining = append(remaining, subscription)
+			}
+		}
+
+		update(tenant, func() { topic.Subscriptions = remaining })
+	}
+}
@@ -2,8 +2,10 @@ package utils
 
 import (
 	"apim-multi-tenant-asb-load-test/apis"
+	"apim-multi-tenant-asb-load-test/state"
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/google/uuid"
 	"log"
@@ -37,26 +39,13 @@ func SaveLinesToFile(filename string, lines []string) error {
 	return os.WriteFile(filename, buffer.Bytes(), 0644)
 }
 
-// GenerateOrgAndDataPlaneIDs generates a specified number of UUIDs and writes them to a file.
-func GenerateOrgAndDataPlaneIDs(numUUIDs int) {
-	file, err := os.Create("organization_ids.txt")
-	if err != nil {
-		log.Fatalf("Failed to create file: %v", err)
-	}
-	defer file.Close()
-
-	for i := 0; i < numUUIDs; i++ {
-		orgID := uuid.New().String()
-		dataPlaneID := uuid.New().String()
-
-		// Write <org_uuid>,<dataplane_id> to file
-		_, err := file.WriteString(fmt.Sprintf("%s,%s\n", orgID, dataPlaneID))
-		if err != nil {
-			log.Fatalf("Failed to write to file: %v", err)
-		}
+// GenerateTenants generates the specified number of tenants, each with a fresh org and data plane UUID.
+func GenerateTenants(numTenants int) []*state.Tenant {
+	tenants := make([]*state.Tenant, 0, numTenants)
+	for i := 0; i < numTenants; i++ {
+		tenants = append(tenants, state.NewTenant(uuid.New().String(), uuid.New().String()))
 	}
-
-	fmt.Println("UUIDs successfully written to organization_ids.txt")
+	return tenants
 }
 
 // ReadAsbTopicAndConnectionStringsFromFile Reads topics and connection strings from the file.
@@ -112,45 +101,91 @@ func ReadOrgAndDataPlaneIDs(filename string) ([][2]string, error) {
 	return orgDataPlanePairs, nil
 }
 
-// CreateEnvironmentsFromFile reads org and data plane IDs and creates environments in parallel.
-func CreateEnvironmentsFromFile(filename, authToken string, maxParallel int) {
-	orgDataPlanePairs, err := ReadOrgAndDataPlaneIDs(filename)
-	if err != nil {
-		log.Fatalf("Error reading org and data plane IDs: %v", err)
-	}
-
+// CreateEnvironments creates environments in parallel for the tenants that don't have one yet.
+func CreateEnvironments(ctx context.Context, store *state.Store, client *apis.Client, maxParallel int) {
 	// Create a semaphore to control the number of parallel goroutines.
 	sem := make(chan struct{}, maxParallel)
 	var wg sync.WaitGroup
 
-	for _, pair := range orgDataPlanePairs {
-		orgID, dataPlaneID := pair[0], pair[1]
-		name := fmt.Sprintf("development-%s", dataPlaneID[len(dataPlaneID)-6:]) // Example name generation
+	for _, tenant := range store.Tenants() {
+		if tenant.Environment.Created {
+			continue
+		}
+
+		// Stop starting new tenants once the context is cancelled.
+		if ctx.Err() != nil {
+			break
+		}
 
 		// Acquire a semaphore slot.
 		sem <- struct{}{}
 		wg.Add(1)
 
-		go func(orgID, name, dataPlaneID string) {
+		go func(tenant *state.Tenant) {
 			defer wg.Done()
+			defer func() { <-sem }()
 
 			// Create environment and handle errors.
-			err := apis.CreateEnvironment(orgID, name, dataPlaneID, authToken)
+			envID, err := client.CreateEnvironment(ctx, tenant.OrgID, tenant.Environment.Name, tenant.DataPlaneID)
 			if err != nil {
-				log.Printf("Failed to create environment for Org: %s, DataPlane: %s, Error: %v", orgID, dataPlaneID, err)
-			} else {
-				fmt.Printf("Successfully created environment for Org: %s, DataPlane: %s\n", orgID, dataPlaneID)
+				log.Printf("Failed to create environment for Org: %s, DataPlane: %s, Error: %v", tenant.OrgID, tenant.DataPlaneID, err)
+				return
 			}
+			fmt.Printf("Successfully created environment for Org: %s, DataPlane: %s\n", tenant.OrgID, tenant.DataPlaneID)
 
-			// Release the semaphore slot.
-			<-sem
-		}(orgID, name, dataPlaneID)
+			if err := store.Update(func(*state.Run) {
+				tenant.Environment.ID = envID
+				tenant.Environment.Created = true
+			}); err != nil {
+				log.Printf("Failed to save state for Org: %s: %v", tenant.OrgID, err)
+			}
+		}(tenant)
 	}
 
 	// Wait for all goroutines to complete.
 	wg.Wait()
 }
 
+// RegisterTopics registers dataplane topics in parallel for the tenants that don't have topics yet.
+func RegisterTopics(ctx context.Context, store *state.Store, client *apis.Client, maxParallel int) {
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+
+	for _, tenant := range store.Tenants() {
+		if len(tenant.Topics) > 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(tenant *state.Tenant) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			topics, err := client.RegisterDataplaneTopics(ctx, tenant.OrgID, tenant.DataPlaneID)
+			if err != nil {
+				log.Printf("Error registering topics for OrgID: %s, DataPlaneID: %s - %v", tenant.OrgID, tenant.DataPlaneID, err)
+				return
+			}
+
+			err = store.Update(func(*state.Run) {
+				for _, topic := range topics {
+					tenant.Topics = append(tenant.Topics, state.Topic{Name: topic.TopicName, ConnectionString: topic.ConnectionString})
+				}
+			})
+			if err != nil {
+				log.Printf("Error saving topics for OrgID: %s, DataPlaneID: %s - %v", tenant.OrgID, tenant.DataPlaneID, err)
+			}
+		}(tenant)
+	}
+
+	wg.Wait()
+}
+
 // LoadAPIData loads the API data from the given file.
 func LoadAPIData(filename string) ([][]string, error) {
 	file, err := os.Open(filename)
@@ -175,3 +210,33 @@ func LoadAPIData(filename string) ([][]string, error) {
 	}
 	return apiData, nil
 }
+
+// DeleteOldestRevision deletes the oldest revision of an API that isn't deployed anywhere, to make
+// room for a new one under APIM's revision limit, and returns its ID.
+func DeleteOldestRevision(ctx context.Context, client *apis.Client, orgID, apiID string) (string, error) {
+	list, err := client.GetRevisions(ctx, apiID, orgID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list revisions: %w", err)
+	}
+	for _, revision := range list.List {
+		if len(revision.DeploymentInfo) > 0 {
+			continue
+		}
+		if err := client.DeleteRevision(ctx, apiID, revision.ID, orgID); err != nil {
+			return "", fmt.Errorf("failed to delete revision %s: %w", revision.ID, err)
+		}
+		return revision.ID, nil
+	}
+	return "", fmt.Errorf("all %d revisions are deployed", len(list.List))
+}
+
+// WithoutRevision returns revisions without the one with the given ID.
+func WithoutRevision(revisions []state.Revision, id string) []state.Revision {
+	kept := revisions[:0]
+	for _, revision := range revisions {
+		if revision.ID != id {
+			kept = append(kept, revision)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"apim-multi-tenant-asb-load-test/config"
+	"apim-multi-tenant-asb-load-test/utils"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Arrivals decides when deployments are due, as offsets from the start of the run.
+type Arrivals interface {
+	// Next returns the offset of the next deployment, or false when no more deployments are due.
+	Next() (time.Duration, bool)
+	// TargetRate returns the intended number of deployments per second at offset t.
+	TargetRate(t time.Duration) float64
+}
+
+// NewArrivals returns the arrival process described by cfg, following profile for constant and
+// poisson arrivals.
+func NewArrivals(cfg config.WorkloadConfig, profile *Profile, rng *rand.Rand) (Arrivals, error) {
+	switch cfg.Arrival {
+	case "constant":
+		return &constantArrivals{profile: profile}, nil
+	case "poisson":
+		return &poissonArrivals{profile: profile, rng: rng}, nil
+	case "schedule":
+		offsets := append([]time.Duration(nil), cfg.Schedule...)
+		if cfg.ScheduleFile != "" {
+			fromFile, err := readSchedule(cfg.ScheduleFile)
+			if err != nil {
+				return nil, err
+			}
+			offsets = append(offsets, fromFile...)
+		}
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		return &scheduleArrivals{offsets: offsets}, nil
+	default:
+		return nil, fmt.Errorf("unknown arrival process %q", cfg.Arrival)
+	}
+}
+
+// constantArrivals issues deployments evenly spaced at the profile's rate.
+type constantArrivals struct {
+	profile *Profile
+	n       float64
+}
+
+func (a *constantArrivals) Next() (time.Duration, bool) {
+	a.n++
+	return a.profile.OffsetOf(a.n)
+}
+
+func (a *constantArrivals) TargetRate(t time.Duration) float64 {
+	return a.profile.RateAt(t)
+}
+
+// poissonArrivals issues deployments with exponentially distributed gaps at the profile's rate,
+// modelling independent clients that don't coordinate with each other.
+type poissonArrivals struct {
+	profile *Profile
+	rng     *rand.Rand
+	n       float64
+}
+
+func (a *poissonArrivals) Next() (time.Duration, bool) {
+	a.n += a.rng.ExpFloat64()
+	return a.profile.OffsetOf(a.n)
+}
+
+func (a *poissonArrivals) TargetRate(t time.Duration) float64 {
+	return a.profile.RateAt(t)
+}
+
+// scheduleArrivals issues deployments at a fixed list of offsets.
+type scheduleArrivals struct {
+	offsets []time.Duration
+	i       int
+}
+
+func (a *scheduleArrivals) Next() (time.Duration, bool) {
+	if a.i >= len(a.offsets) {
+		return 0, false
+	}
+	t := a.offsets[a.i]
+	a.i++
+	return t, true
+}
+
+// TargetRate is the average rate of the whole schedule.
+func (a *scheduleArrivals) TargetRate(time.Duration) float64 {
+	if len(a.offsets) == 0 || a.offsets[len(a.offsets)-1] <= 0 {
+		return 0
+	}
+	return float64(len(a.offsets)) / a.offsets[len(a.offsets)-1].Seconds()
+}
+
+// readSchedule reads one offset per line, e.g. "1.5s" or "250ms".
+func readSchedule(filename string) ([]time.Duration, error) {
+	lines, err := utils.LoadLinesFromFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule file: %w", err)
+	}
+	offsets := make([]time.Duration, 0, len(lines))
+	for _, line := range lines {
+		offset, err := time.ParseDuration(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q in schedule file: %w", line, err)
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets, nil
+}
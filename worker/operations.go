@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"apim-multi-tenant-asb-load-test/apis"
+	"apim-multi-tenant-asb-load-test/config"
+	"apim-multi-tenant-asb-load-test/state"
+	"apim-multi-tenant-asb-load-test/utils"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Operation is a control plane operation issued by the generator.
+type Operation int
+
+const (
+	Deploy Operation = iota
+	Undeploy
+	Update
+	Lifecycle
+	Delete
+	numOperations
+)
+
+// operationNames and eventTypes are indexed by Operation. Each operation is correlated with the
+// gateway event of its type.
+var (
+	operationNames = [numOperations]string{"deploy", "undeploy", "update", "lifecycle", "delete"}
+	eventTypes     = [numOperations]string{
+		"DEPLOY_API_IN_GATEWAY",
+		"UNDEPLOY_API_FROM_GATEWAY",
+		"API_UPDATE",
+		"API_LIFECYCLE_CHANGE",
+		"API_DELETE",
+	}
+)
+
+func (o Operation) String() string {
+	return operationNames[o]
+}
+
+// EventType returns the type of the gateway event the operation is expected to produce.
+func (o Operation) EventType() string {
+	return eventTypes[o]
+}
+
+// Mix picks the operation issued at each arrival in proportion to the configured weights.
+type Mix struct {
+	operations []Operation
+	cumulative []float64
+	rng        *rand.Rand
+}
+
+// NewMix returns the operation mix configured by cfg, drawing from rng.
+func NewMix(cfg config.OperationsConfig, rng *rand.Rand) *Mix {
+	weights := [numOperations]float64{cfg.Deploy, cfg.Undeploy, cfg.Update, cfg.Lifecycle, cfg.Delete}
+	mix := &Mix{rng: rng}
+	total := 0.0
+	for op, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		mix.operations = append(mix.operations, Operation(op))
+		mix.cumulative = append(mix.cumulative, total)
+	}
+	return mix
+}
+
+// Next returns the operation for the next arrival.
+func (m *Mix) Next() Operation {
+	if len(m.operations) == 1 {
+		return m.operations[0]
+	}
+	draw := m.rng.Float64() * m.cumulative[len(m.cumulative)-1]
+	i := sort.Search(len(m.cumulative), func(i int) bool { return m.cumulative[i] > draw })
+	return m.operations[min(i, len(m.operations)-1)]
+}
+
+// deploy deploys a revision of the tenant's API to its environment.
+func (g *Generator) deploy(ctx context.Context, t *target, index int, revisionID string, segment int) {
+	apiID, _ := t.api()
+	env := t.tenant.Environment
+	err := g.track(ctx, segment, index, Deploy, apiID, revisionID, func(ctx context.Context) error {
+		return g.client.DeployAPIRevision(ctx, apiID, revisionID, t.tenant.OrgID, env.Name, env.VHost)
+	})
+	if err != nil {
+		t.mu.Lock()
+		if t.deployed == revisionID {
+			t.deployed = ""
+		}
+		t.mu.Unlock()
+	}
+}
+
+// undeploy removes the revision the tenant's last deployment went to from its environment.
+func (g *Generator) undeploy(ctx context.Context, t *target, index int, revisionID string, segment int) {
+	apiID, _ := t.api()
+	env := t.tenant.Environment
+	err := g.track(ctx, segment, index, Undeploy, apiID, revisionID, func(ctx context.Context) error {
+		return g.client.UndeployAPIRevision(ctx, apiID, revisionID, t.tenant.OrgID, env.Name, env.VHost)
+	})
+	if err != nil {
+		// The revision most likely is still deployed.
+		t.mu.Lock()
+		if t.deployed == "" {
+			t.deployed = revisionID
+		}
+		t.mu.Unlock()
+	}
+}
+
+// update changes the description of the tenant's API and creates a revision of the new definition,
+// which later deployments rotate to. When the API holds as many revisions as APIM allows, or APIM
+// reports the limit reached, the oldest undeployed revision is deleted first.
+func (g *Generator) update(ctx context.Context, t *target, index, segment int) {
+	apiID, name := t.api()
+	orgID := t.tenant.OrgID
+	updatedAt := time.Now().Format(time.RFC3339Nano)
+	description := fmt.Sprintf("This API is used to connect to the TestAPI service, updated at %s", updatedAt)
+	err := g.track(ctx, segment, index, Update, apiID, "", func(ctx context.Context) error {
+		return g.client.UpdateAPI(ctx, apiID, name, orgID, description)
+	})
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	revisions := len(t.tenant.APIs[0].Revisions)
+	t.mu.Unlock()
+	if g.revisionLimit > 0 && revisions >= g.revisionLimit && !g.makeRoom(ctx, t, index, segment, apiID) {
+		return
+	}
+	revisionID, err := g.client.CreateRevision(ctx, apiID, orgID, "update at "+updatedAt)
+	// APIM may hold revisions the state doesn't know about.
+	if apis.IsRevisionLimit(err) {
+		if !g.makeRoom(ctx, t, index, segment, apiID) {
+			return
+		}
+		revisionID, err = g.client.CreateRevision(ctx, apiID, orgID, "update at "+updatedAt)
+	}
+	if err != nil {
+		g.failStep(segment, index, Update, "create_revision", err)
+		g.log.Printf("Failed to create revision for API %s: %v\n", apiID, err)
+		return
+	}
+	g.save(t, func(api *state.API) { api.Revisions = append(api.Revisions, state.Revision{ID: revisionID}) })
+}
+
+// makeRoom deletes the oldest undeployed revision of the tenant's API and reports whether it did.
+func (g *Generator) makeRoom(ctx context.Context, t *target, index, segment int, apiID string) bool {
+	deleted, err := utils.DeleteOldestRevision(ctx, g.client, t.tenant.OrgID, apiID)
+	if err != nil {
+		g.failStep(segment, index, Update, "delete_revision", err)
+		g.log.Printf("Failed to make room for a revision of API %s: %v\n", apiID, err)
+		return false
+	}
+	g.save(t, func(api *state.API) { api.Revisions = utils.WithoutRevision(api.Revisions, deleted) })
+	return true
+}
+
+// changeLifecycle publishes the tenant's API, or deprecates it if it is published already.
+func (g *Generator) changeLifecycle(ctx context.Context, t *target, index, segment int) {
+	apiID, _ := t.api()
+	t.mu.Lock()
+	status := t.tenant.APIs[0].Status
+	t.mu.Unlock()
+
+	action := "Publish"
+	switch status {
+	case "PUBLISHED":
+		action = "Deprecate"
+	case "DEPRECATED":
+		action = "Re-Publish"
+	}
+
+	var lifecycleState string
+	err := g.track(ctx, segment, index, Lifecycle, apiID, "", func(ctx context.Context) error {
+		var err error
+		lifecycleState, err = g.client.ChangeLifecycle(ctx, apiID, t.tenant.OrgID, action)
+		return err
+	})
+	if err != nil || lifecycleState == "" {
+		return
+	}
+	g.save(t, func(api *state.API) { api.Status = strings.ToUpper(lifecycleState) })
+}
+
+// deleteScratch creates a scratch API for the tenant and deletes it. The scratch API is recorded in
+// the state while it exists, so teardown removes it if the delete fails.
+func (g *Generator) deleteScratch(ctx context.Context, t *target, index, segment int) {
+	orgID := t.tenant.OrgID
+	name := fmt.Sprintf("scratch%s%d", orgID[len(orgID)-6:], g.scratch.Add(1))
+	apiID, err := g.client.CreateAPI(ctx, name, orgID)
+	if err != nil {
+		g.failStep(segment, index, Delete, "create_api", err)
+		g.log.Printf("Failed to create scratch API %s: %v\n", name, err)
+		return
+	}
+	g.records.Own(apiID, orgID)
+	g.saveTenant(t, func(tenant *state.Tenant) { tenant.APIs = append(tenant.APIs, state.API{ID: apiID, Name: name}) })
+
+	err = g.track(ctx, segment, index, Delete, apiID, "", func(ctx context.Context) error {
+		return g.client.DeleteAPI(ctx, apiID, orgID)
+	})
+	if err != nil {
+		return
+	}
+	g.saveTenant(t, func(tenant *state.Tenant) {
+		kept := tenant.APIs[:0]
+		for _, api := range tenant.APIs {
+			if api.ID != apiID {
+				kept = append(kept, api)
+			}
+		}
+		tenant.APIs = kept
+	})
+}
+
+// save applies fn to the tenant's API and defers saving the state.
+func (g *Generator) save(t *target, fn func(api *state.API)) {
+	g.saveTenant(t, func(tenant *state.Tenant) { fn(&tenant.APIs[0]) })
+}
+
+// saveTenant applies fn to the tenant and defers saving the state, which the run flushes
+// periodically.
+func (g *Generator) saveTenant(t *target, fn func(tenant *state.Tenant)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g.store.Defer(func(*state.Run) { fn(t.tenant) })
+}
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"apim-multi-tenant-asb-load-test/config"
+	"math"
+	"time"
+)
+
+// Profile is a piecewise linear target rate over the run, made of named segments.
+type Profile struct {
+	segments []config.ProfileSegment
+	// unbounded marks a profile whose only segment runs until the run is interrupted.
+	unbounded bool
+}
+
+// NewProfile returns the profile described by cfg. Without explicit segments the whole run is a
+// single "steady" segment at cfg.Rate lasting cfg.Duration, or forever if that is zero.
+func NewProfile(cfg config.WorkloadConfig) *Profile {
+	if len(cfg.Profile) > 0 {
+		return &Profile{segments: cfg.Profile}
+	}
+	return &Profile{
+		segments:  []config.ProfileSegment{{Name: "steady", Duration: cfg.Duration, From: cfg.Rate, To: cfg.Rate}},
+		unbounded: cfg.Duration == 0,
+	}
+}
+
+// Segments returns the names of the segments in order.
+func (p *Profile) Segments() []string {
+	names := make([]string, len(p.segments))
+	for i, segment := range p.segments {
+		names[i] = segment.Name
+	}
+	return names
+}
+
+// Duration returns the length of the profile, or false if it runs until interrupted.
+func (p *Profile) Duration() (time.Duration, bool) {
+	if p.unbounded {
+		return 0, false
+	}
+	var total time.Duration
+	for _, segment := range p.segments {
+		total += segment.Duration
+	}
+	return total, true
+}
+
+// SegmentAt returns the index of the segment that offset t falls in. An offset on a boundary belongs
+// to the segment that ends there, and offsets past the end belong to the last segment.
+func (p *Profile) SegmentAt(t time.Duration) int {
+	for i, segment := range p.segments {
+		if p.unbounded || t <= segment.Duration {
+			return i
+		}
+		t -= segment.Duration
+	}
+	return len(p.segments) - 1
+}
+
+// RateAt returns the target rate at offset t, or zero past the end of the profile.
+func (p *Profile) RateAt(t time.Duration) float64 {
+	for _, segment := range p.segments {
+		if p.unbounded {
+			return segment.From
+		}
+		if t < segment.Duration {
+			return segment.From + (segment.To-segment.From)*t.Seconds()/segment.Duration.Seconds()
+		}
+		t -= segment.Duration
+	}
+	return 0
+}
+
+// OffsetOf returns the offset by which n deployments are due, i.e. where the integral of the rate
+// reaches n, or false if the profile ends first. Placing arrivals this way follows ramps exactly,
+// including ramps that start from zero.
+func (p *Profile) OffsetOf(n float64) (time.Duration, bool) {
+	var start time.Duration
+	for _, segment := range p.segments {
+		if p.unbounded {
+			if segment.From <= 0 {
+				return 0, false
+			}
+			return start + seconds(n/segment.From), true
+		}
+
+		d := segment.Duration.Seconds()
+		count := (segment.From + segment.To) / 2 * d
+		if n > count {
+			n -= count
+			start += segment.Duration
+			continue
+		}
+
+		// Solve from*x + (to-from)/(2d)*x^2 = n for the offset x into the segment.
+		a := (segment.To - segment.From) / (2 * d)
+		b := segment.From
+		var x float64
+		if math.Abs(a) < 1e-12 {
+			if b <= 0 {
+				return 0, false
+			}
+			x = n / b
+		} else {
+			x = (-b + math.Sqrt(b*b+4*a*n)) / (2 * a)
+		}
+		return start + seconds(x), true
+	}
+	return 0, false
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
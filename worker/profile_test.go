@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"apim-multi-tenant-asb-load-test/config"
+	"testing"
+	"time"
+)
+
+func TestProfileOffsetOf(t *testing.T) {
+	steady := func(d time.Duration, rate float64) config.ProfileSegment {
+		return config.ProfileSegment{Name: "steady", Duration: d, From: rate, To: rate}
+	}
+	ramp := func(d time.Duration, from, to float64) config.ProfileSegment {
+		return config.ProfileSegment{Name: "ramp", Duration: d, From: from, To: to}
+	}
+
+	tests := []struct {
+		name    string
+		cfg     config.WorkloadConfig
+		n       float64
+		want    time.Duration
+		wantOK  bool
+		segment int
+	}{
+		{name: "unbounded", cfg: config.WorkloadConfig{Rate: 10}, n: 5, want: 500 * time.Millisecond, wantOK: true},
+		{name: "unbounded at zero rate", cfg: config.WorkloadConfig{Rate: 0}, n: 1},
+		{name: "bounded", cfg: config.WorkloadConfig{Rate: 2, Duration: 10 * time.Second}, n: 20, want: 10 * time.Second, wantOK: true},
+		{name: "past the end", cfg: config.WorkloadConfig{Rate: 2, Duration: 10 * time.Second}, n: 21},
+		{
+			name: "ramp up from zero",
+			cfg:  config.WorkloadConfig{Profile: []config.ProfileSegment{ramp(10*time.Second, 0, 10)}},
+			// The integral of the rate is t^2/2.
+			n: 8, want: 4 * time.Second, wantOK: true,
+		},
+		{
+			name: "ramp down",
+			cfg:  config.WorkloadConfig{Profile: []config.ProfileSegment{ramp(10*time.Second, 10, 0)}},
+			// The integral of the rate is 10t - t^2/2.
+			n: 18, want: 2 * time.Second, wantOK: true,
+		},
+		{
+			name: "second segment",
+			cfg:  config.WorkloadConfig{Profile: []config.ProfileSegment{ramp(10*time.Second, 0, 10), steady(10*time.Second, 10)}},
+			n:    60, want: 11 * time.Second, wantOK: true, segment: 1,
+		},
+		{
+			name: "after a pause",
+			cfg:  config.WorkloadConfig{Profile: []config.ProfileSegment{steady(5*time.Second, 0), steady(10*time.Second, 2)}},
+			n:    1, want: 5500 * time.Millisecond, wantOK: true, segment: 1,
+		},
+		{
+			name: "end of the first segment",
+			cfg:  config.WorkloadConfig{Profile: []config.ProfileSegment{steady(10*time.Second, 1), steady(10*time.Second, 5)}},
+			n:    10, want: 10 * time.Second, wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProfile(tt.cfg)
+			got, ok := p.OffsetOf(tt.n)
+			if ok != tt.wantOK {
+				t.Fatalf("OffsetOf(%v) = %v, %t, want ok %t", tt.n, got, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if diff := got - tt.want; diff > time.Microsecond || diff < -time.Microsecond {
+				t.Errorf("OffsetOf(%v) = %v, want %v", tt.n, got, tt.want)
+			}
+			if segment := p.SegmentAt(got); segment != tt.segment {
+				t.Errorf("SegmentAt(%v) = %d, want %d", got, segment, tt.segment)
+			}
+		})
+	}
+}
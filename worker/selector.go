@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"apim-multi-tenant-asb-load-test/config"
+	"apim-multi-tenant-asb-load-test/state"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Selector picks the tenant each deployment goes to. Next returns an index into the tenants the
+// selector was built for. Selectors are not safe for concurrent use.
+type Selector interface {
+	Next() int
+}
+
+// NewSelector returns the selector configured by cfg over tenants. Random strategies draw from rng,
+// so a seeded rng reproduces the same sequence of tenants.
+func NewSelector(cfg config.SelectionConfig, tenants []*state.Tenant, rng *rand.Rand) (Selector, error) {
+	n := len(tenants)
+	if n == 0 {
+		return nil, fmt.Errorf("no tenants to select from")
+	}
+	switch cfg.Strategy {
+	case "round-robin", "":
+		return &roundRobin{n: n}, nil
+	case "random":
+		return &uniform{n: n, rng: rng}, nil
+	case "weighted":
+		return newWeighted(cfg, tenants, rng)
+	case "zipf":
+		if n == 1 {
+			return &roundRobin{n: n}, nil
+		}
+		// Ranks are assigned through a seeded permutation so the hottest tenants are not simply the
+		// first ones in the state file.
+		return &zipf{z: rand.NewZipf(rng, cfg.ZipfExponent, 1, uint64(n-1)), ranks: rng.Perm(n)}, nil
+	case "hot":
+		hot := int(math.Round(cfg.HotFraction * float64(n)))
+		hot = max(1, min(hot, n))
+		return &hotSet{hot: hot, share: cfg.HotShare, order: rng.Perm(n), rng: rng}, nil
+	default:
+		return nil, fmt.Errorf("unknown tenant selection strategy %q", cfg.Strategy)
+	}
+}
+
+// roundRobin cycles through the tenants in order.
+type roundRobin struct {
+	n    int
+	next int
+}
+
+func (s *roundRobin) Next() int {
+	i := s.next
+	s.next = (s.next + 1) % s.n
+	return i
+}
+
+// uniform picks every tenant with the same probability.
+type uniform struct {
+	n   int
+	rng *rand.Rand
+}
+
+func (s *uniform) Next() int {
+	return s.rng.Intn(s.n)
+}
+
+// weighted picks tenants in proportion to their configured weights.
+type weighted struct {
+	cumulative []float64
+	rng        *rand.Rand
+}
+
+func newWeighted(cfg config.SelectionConfig, tenants []*state.Tenant, rng *rand.Rand) (*weighted, error) {
+	known := make(map[string]bool, len(tenants))
+	cumulative := make([]float64, len(tenants))
+	total := 0.0
+	for i, tenant := range tenants {
+		known[tenant.OrgID] = true
+		weight, ok := cfg.Weights[tenant.OrgID]
+		if !ok {
+			weight = cfg.DefaultWeight
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("weight of tenant %s must not be negative, got %g", tenant.OrgID, weight)
+		}
+		total += weight
+		cumulative[i] = total
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("tenant weights sum to zero")
+	}
+	for orgID := range cfg.Weights {
+		if !known[orgID] {
+			log.Printf("Ignoring weight of unknown or undeployable tenant %s\n", orgID)
+		}
+	}
+	return &weighted{cumulative: cumulative, rng: rng}, nil
+}
+
+func (s *weighted) Next() int {
+	draw := s.rng.Float64() * s.cumulative[len(s.cumulative)-1]
+	// The first cumulative weight above the draw belongs to the selected tenant, which skips
+	// tenants with zero weight.
+	i := sort.Search(len(s.cumulative), func(i int) bool { return s.cumulative[i] > draw })
+	return min(i, len(s.cumulative)-1)
+}
+
+// zipf picks tenants with a Zipf distribution over their ranks.
+type zipf struct {
+	z     *rand.Zipf
+	ranks []int
+}
+
+func (s *zipf) Next() int {
+	return s.ranks[s.z.Uint64()]
+}
+
+// hotSet sends share of the deployments to a fixed set of hot tenants and spreads the rest
+// uniformly over the others.
+type hotSet struct {
+	hot   int
+	share float64
+	order []int
+	rng   *rand.Rand
+}
+
+func (s *hotSet) Next() int {
+	if s.hot == len(s.order) || s.rng.Float64() < s.share {
+		return s.order[s.rng.Intn(s.hot)]
+	}
+	return s.order[s.hot+s.rng.Intn(len(s.order)-s.hot)]
+}
@@ -2,63 +2,449 @@ package worker
 
 import (
 	"apim-multi-tenant-asb-load-test/apis"
+	"apim-multi-tenant-asb-load-test/messaging"
+	"apim-multi-tenant-asb-load-test/metrics"
+	"apim-multi-tenant-asb-load-test/state"
+	"context"
 	"fmt"
-	"math/rand"
+	"log"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// StartRandomDeployments continuously deploys random API revisions using goroutines.
-func StartRandomDeployments(data [][]string, authToken string, msgStore *sync.Map, concurrency int) {
-	var ops atomic.Int64
+// Generator issues operations at the rate given by its arrival process, independent of how fast
+// APIM responds. Arrivals that find the concurrency cap reached are dropped rather than queued, so a
+// slow APIM shows up as dropped arrivals instead of a silently lower rate.
+type Generator struct {
+	client      *apis.Client
+	store       *state.Store
+	targets     []*target
+	selector    Selector
+	mix         *Mix
+	arrivals    Arrivals
+	profile     *Profile
+	concurrency int64
+	// revisionLimit is the number of revisions APIM allows per API, zero if unlimited.
+	revisionLimit int
+	records       *messaging.Correlator
+	log           *log.Logger
+
+	// started is when Run started, in Unix nanoseconds, or zero before.
+	started      atomic.Int64
+	scratch      atomic.Int64
+	inFlight     atomic.Int64
+	total        counters
+	segments     []counters
+	perTenant    []counters
+	perOperation [numOperations]counters
+
+	mu sync.Mutex
+	// failures counts the failed operations by the HTTP status APIM answered with, zero for none.
+	failures map[int]int64
+}
+
+// target is a tenant together with what the generator knows about its API. mu guards the fields
+// and the tenant's APIs, which update, lifecycle and delete operations change during a run.
+type target struct {
+	tenant *state.Tenant
+
+	mu sync.Mutex
+	// rotation counts the deployments of the tenant, to cycle through the revisions of its API.
+	rotation int
+	// deployed is the revision the tenant's last deployment went to, until it is undeployed.
+	deployed string
+}
+
+// counters are the outcomes of the operations issued in a run, a profile segment, for a tenant or
+// of one type.
+type counters struct {
+	issued    atomic.Int64
+	dropped   atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+	// stepFailed counts the operations whose step around the tracked call failed.
+	stepFailed atomic.Int64
+}
+
+// Stats summarizes what a generator did.
+type Stats struct {
+	Elapsed    time.Duration
+	TargetRate float64
+	Issued     int64
+	Dropped    int64
+	Succeeded  int64
+	Failed     int64
+	// StepsFailed counts the operations whose step around the tracked call failed: creating the
+	// scratch API a delete removes, or the revision an update creates. The deletes are neither
+	// succeeded nor failed, the updates are counted by the outcome of the update itself.
+	StepsFailed int64
+	InFlight    int64
+	Segments    []SegmentStats
+	Tenants     []TenantStats
+	Operations  []OperationStats
+	// Failures counts the failed operations by HTTP status, zero when APIM didn't answer.
+	Failures map[int]int64
+}
+
+// SegmentStats summarizes the operations issued during one profile segment.
+type SegmentStats struct {
+	Name      string
+	Issued    int64
+	Dropped   int64
+	Succeeded int64
+	Failed    int64
+}
+
+// OperationStats summarizes the operations of one type.
+type OperationStats struct {
+	Name        string
+	EventType   string
+	Issued      int64
+	Dropped     int64
+	Succeeded   int64
+	Failed      int64
+	StepsFailed int64
+}
+
+// TenantStats summarizes the operations that went to one tenant.
+type TenantStats struct {
+	OrgID     string
+	Issued    int64
+	Dropped   int64
+	Succeeded int64
+	Failed    int64
+}
+
+// AchievedRate returns the number of operations issued per second.
+func (s Stats) AchievedRate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Issued) / s.Elapsed.Seconds()
+}
+
+// TopShare returns the share of the issued operations that went to the busiest fraction of the
+// tenants, e.g. TopShare(0.05) for the busiest 5%.
+func (s Stats) TopShare(fraction float64) float64 {
+	if s.Issued == 0 || len(s.Tenants) == 0 {
+		return 0
+	}
+	issued := make([]int64, len(s.Tenants))
+	for i, tenant := range s.Tenants {
+		issued[i] = tenant.Issued
+	}
+	sort.Slice(issued, func(i, j int) bool { return issued[i] > issued[j] })
+	top := max(1, int(math.Round(fraction*float64(len(issued)))))
+	var sum int64
+	for _, n := range issued[:top] {
+		sum += n
+	}
+	return float64(sum) / float64(s.Issued)
+}
+
+func (s SegmentStats) String() string {
+	return fmt.Sprintf("segment %s: issued: %d, dropped: %d, succeeded: %d, failed: %d", s.Name, s.Issued, s.Dropped, s.Succeeded, s.Failed)
+}
+
+func (s OperationStats) String() string {
+	return fmt.Sprintf("%s (%s): issued: %d, dropped: %d, succeeded: %d, failed: %d, steps failed: %d",
+		s.Name, s.EventType, s.Issued, s.Dropped, s.Succeeded, s.Failed, s.StepsFailed)
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("elapsed: %s, target: %.1f/s, achieved: %.1f/s, issued: %d, dropped: %d, succeeded: %d, failed: %d, steps failed: %d, in flight: %d",
+		s.Elapsed.Round(time.Second), s.TargetRate, s.AchievedRate(), s.Issued, s.Dropped, s.Succeeded, s.Failed, s.StepsFailed, s.InFlight)
+}
+
+// Deployable returns the tenants that have an API revision to deploy.
+func Deployable(tenants []*state.Tenant) []*state.Tenant {
+	var deployable []*state.Tenant
+	for _, tenant := range tenants {
+		if len(tenant.APIs) > 0 && len(tenant.APIs[0].Revisions) > 0 {
+			deployable = append(deployable, tenant)
+		}
+	}
+	return deployable
+}
+
+// NewGenerator returns a generator that issues the operations picked by mix against the API of the
+// tenant chosen by selector, which must have been built over the same tenants. Each deployment of a
+// tenant moves on to the next revision of its API, so consecutive deployments change what the
+// gateway serves. Every operation is tracked in records, tagged with the profile segment it was
+// issued in. Changes to the tenants' APIs are saved to store. Updates keep the revisions of an API
+// within revisionLimit, unless it is zero. Progress and failures are logged to logger.
+func NewGenerator(client *apis.Client, store *state.Store, tenants []*state.Tenant, selector Selector, mix *Mix, arrivals Arrivals, profile *Profile, concurrency, revisionLimit int, records *messaging.Correlator, logger *log.Logger) *Generator {
+	targets := make([]*target, len(tenants))
+	for i, tenant := range tenants {
+		targets[i] = &target{tenant: tenant}
+	}
+	return &Generator{
+		client:        client,
+		store:         store,
+		targets:       targets,
+		selector:      selector,
+		mix:           mix,
+		arrivals:      arrivals,
+		profile:       profile,
+		concurrency:   int64(concurrency),
+		revisionLimit: revisionLimit,
+		records:       records,
+		log:           logger,
+		segments:      make([]counters, len(profile.Segments())),
+		perTenant:     make([]counters, len(tenants)),
+		failures:      map[int]int64{},
+	}
+}
+
+// Run issues operations until the profile ends or ctx is cancelled, logging the achieved rate every
+// reportInterval. Cancelling ctx only stops new operations: those in flight are allowed to complete,
+// bounded by the client timeout, and Run waits for them before returning.
+func (g *Generator) Run(ctx context.Context, reportInterval time.Duration) Stats {
+	opCtx := context.WithoutCancel(ctx)
+
+	if len(g.targets) == 0 {
+		g.log.Println("no API revisions to deploy")
+		return Stats{}
+	}
+	start := time.Now()
+	g.started.Store(start.UnixNano())
 	var wg sync.WaitGroup
-	sem := make(chan struct{}, concurrency) // Semaphore for concurrency control
 
-	rand.Seed(time.Now().UnixNano()) // Seed the random number generator
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
 
-	fmt.Printf("data length: %d\n", len(data))
 	for {
-		// Acquire a semaphore slot before starting a goroutine.
-		sem <- struct{}{}
-		wg.Add(1)
+		offset, ok := g.arrivals.Next()
+		if !ok {
+			break
+		}
+
+		// Wait for the arrival, reporting progress meanwhile. A generator that has fallen behind
+		// issues the overdue operations immediately.
+		timer.Reset(time.Until(start.Add(offset)))
+		waiting := true
+		for waiting {
+			select {
+			case <-timer.C:
+				waiting = false
+			case <-ticker.C:
+				g.log.Printf("Operations: %s\n", g.stats(start))
+			case <-ctx.Done():
+				wg.Wait()
+				return g.stats(start)
+			}
+		}
+
+		index := g.selector.Next()
+		op := g.mix.Next()
+		segment := g.profile.SegmentAt(offset)
 
-		if int(ops.Load()) >= len(data) {
-			ops.Store(0)
+		if g.inFlight.Load() >= g.concurrency {
+			g.count(segment, index, op, func(c *counters) { c.dropped.Add(1) })
+			metrics.OperationsDropped.WithLabelValues(op.String()).Inc()
+			continue
 		}
 
-		// Start a new goroutine for a random deployment.
+		op, revisionID := g.targets[index].next(op)
+		g.inFlight.Add(1)
+		metrics.OperationsInFlight.Inc()
+		g.count(segment, index, op, func(c *counters) { c.issued.Add(1) })
+		metrics.OperationsIssued.WithLabelValues(op.String()).Inc()
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			defer func() {
-				<-sem
-			}()
+			defer metrics.OperationsInFlight.Dec()
+			defer g.inFlight.Add(-1)
+			g.issue(opCtx, index, op, revisionID, segment)
+		}()
+	}
 
-			value := ops.Load()
-			intValue := int(value)
+	wg.Wait()
+	return g.stats(start)
+}
 
-			randomSet := data[intValue]
+// next returns the revision a deploy or undeploy operation applies to. The deployed revision is
+// tracked as operations are issued rather than as they complete, so consecutive undeployments don't
+// target the same revision. An undeployment of a tenant with nothing deployed becomes a deployment.
+func (t *target) next(op Operation) (Operation, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-			ops.Add(1)
+	if op == Undeploy {
+		if t.deployed != "" {
+			revisionID := t.deployed
+			t.deployed = ""
+			return op, revisionID
+		}
+		op = Deploy
+	}
+	if op != Deploy {
+		return op, ""
+	}
+	revisions := t.tenant.APIs[0].Revisions
+	t.deployed = revisions[t.rotation%len(revisions)].ID
+	t.rotation++
+	return op, t.deployed
+}
+
+// api returns the ID and name of the tenant's API.
+func (t *target) api() (string, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tenant.APIs[0].ID, t.tenant.APIs[0].Name
+}
 
-			orgID := randomSet[0]
-			dataPlaneID := randomSet[1]
-			apiID := randomSet[2]
-			revisionID := randomSet[3]
+// issue performs an operation on the API of a tenant.
+func (g *Generator) issue(ctx context.Context, index int, op Operation, revisionID string, segment int) {
+	t := g.targets[index]
+	switch op {
+	case Deploy:
+		g.deploy(ctx, t, index, revisionID, segment)
+	case Undeploy:
+		g.undeploy(ctx, t, index, revisionID, segment)
+	case Update:
+		g.update(ctx, t, index, segment)
+	case Lifecycle:
+		g.changeLifecycle(ctx, t, index, segment)
+	case Delete:
+		g.deleteScratch(ctx, t, index, segment)
+	}
+}
 
-			msgStore.Store(apiID, time.Now())
-			// Perform the API revision deployment.
-			if err := apis.DeployAPIRevision(apiID, revisionID, orgID, dataPlaneID, authToken); err != nil {
-				fmt.Printf("Error deploying API revision:(API_ID: %s, Revision_id: %s, orgID: %s, "+
-					"dataPlaneId: %s) err:%v\n", apiID, revisionID, orgID, dataPlaneID, err)
-			}
-		}()
+// track records an operation, performs it with call and counts its outcome.
+func (g *Generator) track(ctx context.Context, segment, index int, op Operation, apiID, revisionID string, call func(ctx context.Context) error) error {
+	tenant := g.targets[index].tenant
+	record := g.records.Track(&messaging.Record{
+		EventType:   op.EventType(),
+		APIID:       apiID,
+		RevisionID:  revisionID,
+		OrgID:       tenant.OrgID,
+		DataPlaneID: tenant.DataPlaneID,
+		Segment:     g.profile.Segments()[segment],
+		SentAt:      time.Now(),
+	})
 
-		// Add a random delay between 10ms and 50ms before spawning the next goroutine.
-		randomDelay := time.Duration(rand.Intn(40)+10) * time.Millisecond
-		time.Sleep(randomDelay)
+	err := call(ctx)
+	status := apis.StatusCode(err)
+	g.records.Complete(record, status, err)
+	metrics.OperationDuration.WithLabelValues(op.String()).Observe(time.Since(record.SentAt).Seconds())
+	observe(op, status, err)
+	if err != nil {
+		g.count(segment, index, op, func(c *counters) { c.failed.Add(1) })
+		g.fail(status)
+		g.log.Printf("Error during %s:(API_ID: %s, Revision_id: %s, orgID: %s, dataPlaneId: %s) err:%v\n",
+			op, apiID, revisionID, tenant.OrgID, tenant.DataPlaneID, err)
+		return err
 	}
+	g.count(segment, index, op, func(c *counters) { c.succeeded.Add(1) })
+	return nil
+}
 
-	// Ensure all goroutines complete before the program exits (unreachable in this case).
-	wg.Wait()
+// fail counts a failed operation by the HTTP status APIM answered with.
+func (g *Generator) fail(status int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failures[status]++
+}
+
+// observe counts the outcome of an operation and the HTTP status APIM answered with, which is 2xx
+// for every success and empty for failures without a response.
+func observe(op Operation, status int, err error) {
+	outcome, code := "succeeded", "2xx"
+	if err != nil {
+		outcome, code = "failed", ""
+	}
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	metrics.OperationsCompleted.WithLabelValues(op.String(), outcome, code).Inc()
+}
+
+// failStep counts an operation whose step around the tracked call failed, with the HTTP status APIM
+// answered the step with, if any.
+func (g *Generator) failStep(segment, index int, op Operation, step string, err error) {
+	g.count(segment, index, op, func(c *counters) { c.stepFailed.Add(1) })
+	code := ""
+	if status := apis.StatusCode(err); status != 0 {
+		code = strconv.Itoa(status)
+	}
+	metrics.StepsFailed.WithLabelValues(op.String(), step, code).Inc()
+}
+
+// count applies fn to the run totals and to the counters of the segment, the tenant and the
+// operation.
+func (g *Generator) count(segment, tenant int, op Operation, fn func(c *counters)) {
+	fn(&g.total)
+	fn(&g.segments[segment])
+	fn(&g.perTenant[tenant])
+	fn(&g.perOperation[op])
+}
+
+// Stats returns what the generator did so far, while Run is going on or after. It returns zero stats
+// before Run started.
+func (g *Generator) Stats() Stats {
+	started := g.started.Load()
+	if started == 0 {
+		return Stats{}
+	}
+	return g.stats(time.Unix(0, started))
+}
+
+// stats returns the counters of a run that started at start.
+func (g *Generator) stats(start time.Time) Stats {
+	elapsed := time.Since(start)
+	stats := Stats{
+		Elapsed:     elapsed,
+		TargetRate:  g.arrivals.TargetRate(elapsed),
+		Issued:      g.total.issued.Load(),
+		Dropped:     g.total.dropped.Load(),
+		Succeeded:   g.total.succeeded.Load(),
+		Failed:      g.total.failed.Load(),
+		StepsFailed: g.total.stepFailed.Load(),
+		InFlight:    g.inFlight.Load(),
+	}
+	for i, name := range g.profile.Segments() {
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name:      name,
+			Issued:    g.segments[i].issued.Load(),
+			Dropped:   g.segments[i].dropped.Load(),
+			Succeeded: g.segments[i].succeeded.Load(),
+			Failed:    g.segments[i].failed.Load(),
+		})
+	}
+	for i, target := range g.targets {
+		stats.Tenants = append(stats.Tenants, TenantStats{
+			OrgID:     target.tenant.OrgID,
+			Issued:    g.perTenant[i].issued.Load(),
+			Dropped:   g.perTenant[i].dropped.Load(),
+			Succeeded: g.perTenant[i].succeeded.Load(),
+			Failed:    g.perTenant[i].failed.Load(),
+		})
+	}
+	for op := range numOperations {
+		stats.Operations = append(stats.Operations, OperationStats{
+			Name:        op.String(),
+			EventType:   op.EventType(),
+			Issued:      g.perOperation[op].issued.Load(),
+			Dropped:     g.perOperation[op].dropped.Load(),
+			Succeeded:   g.perOperation[op].succeeded.Load(),
+			Failed:      g.perOperation[op].failed.Load(),
+			StepsFailed: g.perOperation[op].stepFailed.Load(),
+		})
+	}
+	g.mu.Lock()
+	stats.Failures = make(map[int]int64, len(g.failures))
+	for status, n := range g.failures {
+		stats.Failures[status] = n
+	}
+	g.mu.Unlock()
+	return stats
 }